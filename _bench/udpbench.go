@@ -0,0 +1,107 @@
+// udpbench measures the UDP ingestion rate of a running statsd-vis. It sends
+// single-line counter packets as fast as it can from several goroutines, and
+// then reads the number of packets statsd-vis actually received from its
+// internal "statsd-vis.packets_received" metric.
+//
+// To compare UDP reader settings, run statsd-vis with each, like:
+//
+//	statsd-vis -flush 1s -udprcvbuf 4194304
+//	statsd-vis -flush 1s -udprcvbuf 4194304 -udpreaders 4 -udpreuseport
+//
+// and run "go run _bench/udpbench.go" against it. To compare aggregator
+// shards, spread the values over many metric names so that they hash to
+// different shards, like:
+//
+//	statsd-vis -flush 1s -udpreaders 4 -udpreuseport -shards 4
+//	go run _bench/udpbench.go -names 1000
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	addr     = flag.String("addr", "127.0.0.1:8125", "statsd UDP `address`")
+	web      = flag.String("web", "http://127.0.0.1:8080", "statsd-vis web UI `url`")
+	senders  = flag.Int("senders", 4, "number of sending goroutines")
+	duration = flag.Duration("duration", 10*time.Second, "`duration` to send for")
+	wait     = flag.Duration("wait", 3*time.Second, "`duration` to wait for statsd-vis to flush")
+	nnames   = flag.Int("names", 1, "number of distinct metric names to send")
+)
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+
+	var sent uint64
+	var wg sync.WaitGroup
+	start := time.Now()
+	stop := start.Add(*duration)
+	pkts := make([][]byte, *nnames)
+	for i := range pkts {
+		pkts[i] = []byte(fmt.Sprintf("udpbench.counter.%d:1|c", i))
+	}
+	for i := 0; i < *senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("udp", *addr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer conn.Close()
+			var n uint64
+			for time.Now().Before(stop) {
+				for i := 0; i < 100; i++ {
+					if _, err := conn.Write(pkts[n%uint64(len(pkts))]); err == nil {
+						n++
+					}
+				}
+			}
+			atomic.AddUint64(&sent, n)
+		}()
+	}
+	wg.Wait()
+	took := time.Since(start)
+	time.Sleep(*wait)
+
+	received := sum("statsd-vis.packets_received", start)
+	overflows := sum("statsd-vis.udp.rcvbuf_overflows", start)
+	secs := took.Seconds()
+	fmt.Printf("sent     %10d packets in %v, %10.0f packets/sec\n", sent, took, float64(sent)/secs)
+	fmt.Printf("received %10.0f packets,            %10.0f packets/sec\n", received, received/secs)
+	fmt.Printf("lost     %10.2f%%, %.0f in kernel receive buffer overflows\n",
+		100*(float64(sent)-received)/float64(sent), overflows)
+}
+
+var rxDatapoint = regexp.MustCompile(`new Date\(\s*(\d+)\s*\*\s*1000\s*\),\s*([-0-9.e+]+|null)`)
+
+// sum adds up the values of the metric since start, from the dashboard page.
+func sum(metric string, start time.Time) (total float64) {
+	resp, err := http.Get(*web + "/dash?g=" + metric)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, m := range rxDatapoint.FindAllSubmatch(body, -1) {
+		at, _ := strconv.ParseInt(string(m[1]), 10, 64)
+		if v, err := strconv.ParseFloat(string(m[2]), 64); err == nil && at >= start.Unix() {
+			total += v
+		}
+	}
+	return
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The JSON API under /api/v1/ returns the metric names and the values of the
+// series, for scripts and tests:
+//
+//	/api/v1/metrics                 the names of the series and their types
+//	/api/v1/query?m=M1,M2&from=&to= the values of the series matching M1, M2
+//
+// M matches like in the web UI. From and to are Unix times in seconds, RFC
+// 3339 times, "now", or durations before now like "-10m" or "-1d", and are the
+// retention period before now and now by default. Times in the results are
+// Unix times in seconds, with milliseconds.
+
+var metricTypeNames = []string{"counter", "timer", "gauge", "set", "generated",
+	"histogram", "distribution"}
+
+type apiMetric struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Generated []string `json:"generated,omitempty"`
+}
+
+type apiSeries struct {
+	Name   string       `json:"name"`
+	Type   string       `json:"type"`
+	Base   string       `json:"base,omitempty"`
+	Points [][2]float64 `json:"points"`
+}
+
+type apiQuery struct {
+	From       float64     `json:"from"`
+	To         float64     `json:"to"`
+	Resolution float64     `json:"resolution"`
+	Series     []apiSeries `json:"series"`
+}
+
+func handleAPI(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/api/v1/metrics") {
+		handleAPIMetrics(w, r)
+	} else if strings.HasSuffix(r.URL.Path, "/api/v1/query") {
+		handleAPIQuery(w, r)
+	} else {
+		apiError(w, http.StatusNotFound, "unknown API endpoint "+r.URL.Path)
+	}
+}
+
+func handleAPIMetrics(w http.ResponseWriter, r *http.Request) {
+	out := []apiMetric{}
+	for t, ns := range names.List() {
+		for _, n := range ns {
+			m := apiMetric{Name: n, Type: metricTypeNames[t]}
+			m.Generated = names.WithGens([]string{n})[1:]
+			sort.Strings(m.Generated)
+			out = append(out, m)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	apiReply(w, out)
+}
+
+func handleAPIQuery(w http.ResponseWriter, r *http.Request) {
+	// tag filters use semicolons, like in the web UI
+	r.URL.RawQuery = strings.Replace(r.URL.RawQuery, ";", "%3B", -1)
+	m := r.FormValue("m")
+	if len(m) == 0 {
+		apiError(w, http.StatusBadRequest, "missing m")
+		return
+	}
+	now := time.Now()
+	from, err := parseTime(r.FormValue("from"), now.Add(-config.retention), now)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+		return
+	}
+	to, err := parseTime(r.FormValue("to"), now, now)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+		return
+	}
+	if to.Before(from) {
+		apiError(w, http.StatusBadRequest, "to is before from")
+		return
+	}
+
+	metrics := names.FindAll(strings.Split(m, ","))
+	res, ts, vs := data.Query(metrics, from, to)
+	out := apiQuery{
+		From:       unixSeconds(from.UnixNano() / 1e6),
+		To:         unixSeconds(to.UnixNano() / 1e6),
+		Resolution: res.Seconds(),
+		Series:     make([]apiSeries, len(metrics)),
+	}
+	for i, n := range metrics {
+		s := apiSeries{Name: n, Points: [][2]float64{}}
+		if t, base, ok := names.Type(n); ok {
+			s.Type, s.Base = metricTypeNames[t], base
+		}
+		for j, t := range ts[i] {
+			if !math.IsNaN(vs[i][j]) {
+				s.Points = append(s.Points, [2]float64{unixSeconds(t), vs[i][j]})
+			}
+		}
+		out.Series[i] = s
+	}
+	apiReply(w, out)
+}
+
+// parseTime parses a time parameter of the API, which is def if empty.
+func parseTime(s string, def, now time.Time) (time.Time, error) {
+	switch {
+	case len(s) == 0:
+		return def, nil
+	case s == "now":
+		return now, nil
+	case strings.HasPrefix(s, "-"):
+		d, err := parseDuration(s[1:])
+		if err != nil {
+			return now, err
+		}
+		return now.Add(-d), nil
+	}
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*1e9)), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// unixSeconds converts Unix milliseconds to seconds.
+func unixSeconds(ms int64) float64 {
+	return float64(ms) / 1000
+}
+
+func apiReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func apiError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Bad lines are counted per reason and per source address, and the most
+// recent ones are kept to be shown in the web UI. The bad line log setting
+// decides if they are also logged: every one of them, a sample of at most one
+// a second, or none.
+const (
+	badLogAll     = iota // log every bad line
+	badLogSampled        // log at most one bad line a second
+	badLogSilent         // do not log bad lines
+)
+
+var badLogNames = []string{"log", "sampled", "silent"}
+
+func badLogMode(s string) int {
+	for i, n := range badLogNames {
+		if s == n {
+			return i
+		}
+	}
+	log.Fatalf("invalid bad line log setting %q, must be one of log, sampled or silent", s)
+	return badLogAll
+}
+
+const (
+	maxBadSources   = 1000 // sources counted separately, the rest are "other"
+	recentBadLines  = 100  // bad lines kept for the web UI
+	maxBadLineShown = 256  // bytes of a bad line that are kept
+)
+
+// badSource is the count of bad lines from one source address.
+type badSource struct {
+	Source string
+	Total  uint64
+	Kinds  [badLineKinds]uint64
+	Last   time.Time
+}
+
+type badLineEntry struct {
+	At     time.Time
+	Source string
+	Reason string
+	Line   string
+}
+
+var badLog struct {
+	sync.Mutex
+	total      uint64
+	kinds      [badLineKinds]uint64
+	sources    map[string]*badSource
+	recent     [recentBadLines]badLineEntry
+	next       int // index in recent for the next bad line
+	lastLog    time.Time
+	suppressed uint64 // bad lines not logged since the last one logged
+}
+
+// sourceOf returns the address bad lines are counted under: the IP address of
+// network clients, or the socket path of unix domain socket clients.
+func sourceOf(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UnixAddr:
+		if a != nil && len(a.Name) > 0 {
+			return a.Name
+		}
+	}
+	return "unix"
+}
+
+// reportBadLine counts a bad line and logs it as per the bad line log
+// setting. It is called from the listeners.
+func reportBadLine(line []byte, rip net.Addr, bad int) {
+	now := time.Now()
+	source := sourceOf(rip)
+	shown := line
+	if len(shown) > maxBadLineShown {
+		shown = shown[:maxBadLineShown]
+	}
+
+	badLog.Lock()
+	badLog.total++
+	badLog.kinds[bad]++
+	bs, ok := badLog.sources[source]
+	if !ok {
+		if badLog.sources == nil {
+			badLog.sources = make(map[string]*badSource)
+		}
+		if len(badLog.sources) >= maxBadSources {
+			source = "other"
+			bs = badLog.sources[source]
+		}
+		if bs == nil {
+			bs = &badSource{Source: source}
+			badLog.sources[source] = bs
+		}
+	}
+	bs.Total++
+	bs.Kinds[bad]++
+	bs.Last = now
+	badLog.recent[badLog.next] = badLineEntry{
+		At:     now,
+		Source: source,
+		Reason: badLineName(bad),
+		Line:   string(shown),
+	}
+	badLog.next = (badLog.next + 1) % recentBadLines
+	logIt := config.badLineLog == badLogAll ||
+		(config.badLineLog == badLogSampled && now.Sub(badLog.lastLog) >= time.Second)
+	var suppressed uint64
+	if logIt {
+		badLog.lastLog = now
+		suppressed = badLog.suppressed
+		badLog.suppressed = 0
+	} else if config.badLineLog == badLogSampled {
+		badLog.suppressed++
+	}
+	badLog.Unlock()
+
+	if !logIt {
+		return
+	}
+	if suppressed > 0 {
+		log.Printf("bad line [%s] from ip [%v]: %s (%d more bad lines not logged)",
+			line, rip, badLineName(bad), suppressed)
+	} else {
+		log.Printf("bad line [%s] from ip [%v]: %s", line, rip, badLineName(bad))
+	}
+}
+
+// badLineCount returns the number of bad lines received since startup.
+func badLineCount() uint64 {
+	badLog.Lock()
+	defer badLog.Unlock()
+	return badLog.total
+}
+
+type badKindCount struct {
+	Reason string
+	Count  uint64
+}
+
+type dataBadLines struct {
+	Total    uint64
+	Kinds    []badKindCount
+	Sources  []badSource
+	Recent   []badLineEntry
+	Mode     string
+	ListPath string
+}
+
+// badLineReport returns the counts and recent bad lines for the web UI, with
+// the sources that sent the most bad lines first, and the most recent lines
+// first.
+func badLineReport() (r dataBadLines) {
+	badLog.Lock()
+	defer badLog.Unlock()
+	r.Total = badLog.total
+	for bad := 1; bad < badLineKinds; bad++ {
+		if badLog.kinds[bad] > 0 {
+			r.Kinds = append(r.Kinds, badKindCount{badLineName(bad), badLog.kinds[bad]})
+		}
+	}
+	for _, bs := range badLog.sources {
+		r.Sources = append(r.Sources, *bs)
+	}
+	sort.Slice(r.Sources, func(i, j int) bool {
+		if r.Sources[i].Total != r.Sources[j].Total {
+			return r.Sources[i].Total > r.Sources[j].Total
+		}
+		return r.Sources[i].Source < r.Sources[j].Source
+	})
+	for i := 1; i <= recentBadLines; i++ {
+		e := badLog.recent[(badLog.next-i+recentBadLines)%recentBadLines]
+		if e.At.IsZero() {
+			break
+		}
+		r.Recent = append(r.Recent, e)
+	}
+	r.Mode = badLogNames[config.badLineLog]
+	return
+}
+
+// Reasons returns the counts of bad lines from the source by reason, like
+// "value: 12, type: 1".
+func (bs badSource) Reasons() string {
+	s := ""
+	for bad := 1; bad < badLineKinds; bad++ {
+		if bs.Kinds[bad] == 0 {
+			continue
+		}
+		if len(s) > 0 {
+			s += ", "
+		}
+		s += badLineName(bad) + ": " + strconv.FormatUint(bs.Kinds[bad], 10)
+	}
+	return s
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Each flush can also be forwarded to one or more Carbon servers, in the
+// plaintext protocol:
+//
+//	<prefix><name> <value> <unix time in seconds>
+//
+// Each server has its own sender goroutine and buffer of flushes. While a
+// server cannot be reached, the flushes are kept in its buffer, and it is
+// reconnected to with an exponential backoff. When the buffer is full, the
+// oldest flushes are dropped to make room for the new ones. The latest flush is
+// always kept.
+
+const (
+	carbonMinBackoff = time.Second
+	carbonMaxBackoff = time.Minute
+	carbonTimeout    = 10 * time.Second
+)
+
+type carbonServer struct {
+	addr     string
+	mu       sync.Mutex
+	batches  [][]byte // encoded flushes waiting to be sent, oldest first
+	lines    []int    // number of lines in each batch
+	buffered int      // lines in batches
+	wake     chan struct{}
+}
+
+var carbonServers []*carbonServer
+
+var (
+	carbonDropped uint64 // lines dropped because a buffer was full, since the last flush
+	carbonSent    uint64 // lines sent since the last flush
+)
+
+// startCarbon starts a sender for each of the Carbon servers.
+func startCarbon() {
+	for _, addr := range strings.Split(config.carbon, ",") {
+		cs := &carbonServer{addr: strings.TrimSpace(addr), wake: make(chan struct{}, 1)}
+		carbonServers = append(carbonServers, cs)
+		go cs.sender()
+	}
+}
+
+// encodeCarbon encodes the flush in the plaintext protocol, and returns the
+// number of lines.
+func encodeCarbon(s *Stats) ([]byte, int) {
+	var buf bytes.Buffer
+	ts := strconv.FormatInt(s.At.Unix(), 10)
+	n := 0
+	for k, v := range s.Metrics {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		buf.WriteString(config.carbonPrefix)
+		buf.WriteString(k)
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		buf.WriteByte(' ')
+		buf.WriteString(ts)
+		buf.WriteByte('\n')
+		n++
+	}
+	return buf.Bytes(), n
+}
+
+// forwardCarbon queues the flush to all the Carbon servers. It is called from
+// the flusher.
+func forwardCarbon(s *Stats) {
+	b, n := encodeCarbon(s)
+	if n == 0 {
+		return
+	}
+	for _, cs := range carbonServers {
+		cs.push(b, n)
+	}
+}
+
+// push adds a batch to the buffer, dropping the oldest ones if it is full. The
+// newest batch is always kept, even if it alone has more lines than the buffer.
+func (cs *carbonServer) push(b []byte, n int) {
+	cs.mu.Lock()
+	cs.batches = append(cs.batches, b)
+	cs.lines = append(cs.lines, n)
+	cs.buffered += n
+	for cs.buffered > config.carbonBuffer && len(cs.batches) > 1 {
+		atomic.AddUint64(&carbonDropped, uint64(cs.lines[0]))
+		cs.buffered -= cs.lines[0]
+		cs.batches, cs.lines = cs.batches[1:], cs.lines[1:]
+	}
+	cs.mu.Unlock()
+	select {
+	case cs.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the oldest batch, if any, without removing it.
+func (cs *carbonServer) next() (b []byte, ok bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.batches) == 0 {
+		return nil, false
+	}
+	return cs.batches[0], true
+}
+
+// sent removes the batch b, if it has not been dropped meanwhile.
+func (cs *carbonServer) sent(b []byte) {
+	cs.mu.Lock()
+	if len(cs.batches) > 0 && &cs.batches[0][0] == &b[0] {
+		atomic.AddUint64(&carbonSent, uint64(cs.lines[0]))
+		cs.buffered -= cs.lines[0]
+		cs.batches, cs.lines = cs.batches[1:], cs.lines[1:]
+	}
+	cs.mu.Unlock()
+}
+
+// The sender thread of a Carbon server.
+func (cs *carbonServer) sender() {
+	var conn net.Conn
+	backoff := carbonMinBackoff
+	failing := false
+	fail := func(what string, err error) {
+		if !failing {
+			log.Printf("carbon %s: %s: %v, retrying with backoff", cs.addr, what, err)
+			failing = true
+		}
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > carbonMaxBackoff {
+			backoff = carbonMaxBackoff
+		}
+	}
+	for {
+		b, ok := cs.next()
+		if !ok {
+			<-cs.wake
+			continue
+		}
+		if conn == nil {
+			var err error
+			if conn, err = net.DialTimeout("tcp", cs.addr, carbonTimeout); err != nil {
+				conn = nil
+				fail("cannot connect", err)
+				continue
+			}
+		}
+		conn.SetWriteDeadline(time.Now().Add(carbonTimeout))
+		if _, err := conn.Write(b); err != nil {
+			fail("cannot send", err)
+			continue
+		}
+		cs.sent(b)
+		if failing {
+			log.Printf("carbon %s: sending again", cs.addr)
+			failing = false
+		}
+		backoff = carbonMinBackoff
+	}
+}
+
+// carbonBuffered returns the number of lines waiting to be sent to all the
+// Carbon servers.
+func carbonBuffered() (n int) {
+	for _, cs := range carbonServers {
+		cs.mu.Lock()
+		n += cs.buffered
+		cs.mu.Unlock()
+	}
+	return
+}
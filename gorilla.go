@@ -0,0 +1,205 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+)
+
+// The points of a series are stored in chunks compressed as described in the
+// Facebook Gorilla paper. The first point of a chunk is stored as is. For the
+// points after it, the timestamp is stored as the delta of its delta from the
+// previous timestamp, in a variable number of bits:
+//
+//	0                   delta of delta is 0
+//	10   + 7 bits       delta of delta in [-64, 63]
+//	110  + 9 bits       delta of delta in [-256, 255]
+//	1110 + 12 bits      delta of delta in [-2048, 2047]
+//	1111 + 64 bits      any other delta of delta
+//
+// and the value is XORed with the previous value, and stored as:
+//
+//	0                   XOR is 0, same value
+//	10 + bits           the meaningful bits of the XOR, if they fit within
+//	                    the leading and trailing zeros of the previous XOR
+//	11 + 5 bits leading zeros + 6 bits number of meaningful bits + bits
+//
+// Timestamps are in milliseconds. A chunk holds up to chunkPoints points.
+
+const chunkPoints = 120
+
+type chunk struct {
+	b     []byte
+	nbits uint // bits used in b
+	n     int  // number of points
+	first int64
+	last  int64
+	// state for appending
+	delta    int64
+	value    uint64
+	leading  uint8
+	trailing uint8
+}
+
+func (c *chunk) writeBit(bit bool) {
+	if c.nbits%8 == 0 {
+		c.b = append(c.b, 0)
+	}
+	if bit {
+		c.b[len(c.b)-1] |= 1 << (7 - c.nbits%8)
+	}
+	c.nbits++
+}
+
+func (c *chunk) writeBits(v uint64, n uint) {
+	for n > 0 {
+		n--
+		c.writeBit(v>>n&1 == 1)
+	}
+}
+
+// full checks if the chunk cannot take more points.
+func (c *chunk) full() bool {
+	return c.n >= chunkPoints
+}
+
+// append adds a point, which must be later than the last point.
+func (c *chunk) append(t int64, v float64) {
+	vb := math.Float64bits(v)
+	if c.n == 0 {
+		c.writeBits(uint64(t), 64)
+		c.writeBits(vb, 64)
+		c.first, c.last, c.value = t, t, vb
+		c.leading = 0xff
+		c.n++
+		return
+	}
+
+	delta := t - c.last
+	dod := delta - c.delta
+	switch {
+	case dod == 0:
+		c.writeBit(false)
+	case -64 <= dod && dod <= 63:
+		c.writeBits(0x2, 2)
+		c.writeBits(uint64(dod), 7)
+	case -256 <= dod && dod <= 255:
+		c.writeBits(0x6, 3)
+		c.writeBits(uint64(dod), 9)
+	case -2048 <= dod && dod <= 2047:
+		c.writeBits(0xe, 4)
+		c.writeBits(uint64(dod), 12)
+	default:
+		c.writeBits(0xf, 4)
+		c.writeBits(uint64(dod), 64)
+	}
+	c.delta, c.last = delta, t
+
+	xor := vb ^ c.value
+	c.value = vb
+	if xor == 0 {
+		c.writeBit(false)
+	} else {
+		leading := uint8(bits.LeadingZeros64(xor))
+		trailing := uint8(bits.TrailingZeros64(xor))
+		if leading > 31 {
+			leading = 31
+		}
+		if c.leading != 0xff && leading >= c.leading && trailing >= c.trailing {
+			c.writeBits(0x2, 2)
+			c.writeBits(xor>>c.trailing, uint(64-c.leading-c.trailing))
+		} else {
+			c.leading, c.trailing = leading, trailing
+			sigbits := 64 - leading - trailing
+			c.writeBits(0x3, 2)
+			c.writeBits(uint64(leading), 5)
+			c.writeBits(uint64(sigbits), 6) // 64 is written as 0
+			c.writeBits(xor>>trailing, uint(sigbits))
+		}
+	}
+	c.n++
+}
+
+// size returns the number of bytes used by the chunk.
+func (c *chunk) size() int {
+	return cap(c.b) + 64
+}
+
+// chunkIter reads the points of a chunk, in order.
+type chunkIter struct {
+	c        *chunk
+	pos      uint
+	i        int
+	t        int64
+	delta    int64
+	value    uint64
+	leading  uint8
+	trailing uint8
+}
+
+func (c *chunk) iter() *chunkIter {
+	return &chunkIter{c: c}
+}
+
+func (it *chunkIter) readBit() bool {
+	bit := it.c.b[it.pos/8]>>(7-it.pos%8)&1 == 1
+	it.pos++
+	return bit
+}
+
+func (it *chunkIter) readBits(n uint) (v uint64) {
+	for ; n > 0; n-- {
+		v <<= 1
+		if it.readBit() {
+			v |= 1
+		}
+	}
+	return
+}
+
+// signed sign extends the n bit value v.
+func signed(v uint64, n uint) int64 {
+	return int64(v<<(64-n)) >> (64 - n)
+}
+
+// next returns the next point, or ok=false if there are no more.
+func (it *chunkIter) next() (t int64, v float64, ok bool) {
+	if it.i >= it.c.n {
+		return
+	}
+	if it.i == 0 {
+		it.t = int64(it.readBits(64))
+		it.value = it.readBits(64)
+		it.i++
+		return it.t, math.Float64frombits(it.value), true
+	}
+
+	var dod int64
+	switch {
+	case !it.readBit():
+	case !it.readBit():
+		dod = signed(it.readBits(7), 7)
+	case !it.readBit():
+		dod = signed(it.readBits(9), 9)
+	case !it.readBit():
+		dod = signed(it.readBits(12), 12)
+	default:
+		dod = int64(it.readBits(64))
+	}
+	it.delta += dod
+	it.t += it.delta
+
+	if it.readBit() {
+		if it.readBit() {
+			it.leading = uint8(it.readBits(5))
+			sigbits := uint8(it.readBits(6))
+			if sigbits == 0 {
+				sigbits = 64
+			}
+			it.trailing = 64 - it.leading - sigbits
+		}
+		sigbits := uint(64 - it.leading - it.trailing)
+		it.value ^= it.readBits(sigbits) << it.trailing
+	}
+	it.i++
+	return it.t, math.Float64frombits(it.value), true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+type point struct {
+	t int64
+	v float64
+}
+
+// roundTrip appends the points to a chunk, and checks that they are read back
+// the same, bit for bit.
+func roundTrip(t *testing.T, name string, ps []point) *chunk {
+	c := &chunk{}
+	for _, p := range ps {
+		c.append(p.t, p.v)
+	}
+	it := c.iter()
+	for i, p := range ps {
+		ts, v, ok := it.next()
+		if !ok {
+			t.Errorf("%s: point %d missing", name, i)
+			return c
+		}
+		if ts != p.t || math.Float64bits(v) != math.Float64bits(p.v) {
+			t.Errorf("%s: point %d is %d %v, want %d %v", name, i, ts, v, p.t, p.v)
+		}
+	}
+	if _, _, ok := it.next(); ok {
+		t.Errorf("%s: more points than appended", name)
+	}
+	return c
+}
+
+func TestChunkTimestamps(t *testing.T) {
+	for _, c := range []struct {
+		dod  int64
+		bits uint // for the timestamp of the third point
+	}{
+		{0, 1},
+		{-64, 2 + 7}, {63, 2 + 7},
+		{-65, 3 + 9}, {64, 3 + 9},
+		{-256, 3 + 9}, {255, 3 + 9},
+		{-257, 4 + 12}, {256, 4 + 12},
+		{-2048, 4 + 12}, {2047, 4 + 12},
+		{-2049, 4 + 64}, {2048, 4 + 64},
+		{1 << 40, 4 + 64}, {-1 << 40, 4 + 64},
+	} {
+		t0 := int64(1500000000000)
+		ps := []point{{t0, 1}, {t0 + 10000, 1}, {t0 + 20000 + c.dod, 1}}
+		ch := roundTrip(t, "dod "+strconv.FormatInt(c.dod, 10), ps[:2])
+		before := ch.nbits
+		ch.append(ps[2].t, ps[2].v)
+		// the same value takes one bit
+		if got := ch.nbits - before - 1; got != c.bits {
+			t.Errorf("dod %d: %d bits, want %d", c.dod, got, c.bits)
+		}
+		roundTrip(t, "dod "+strconv.FormatInt(c.dod, 10), ps)
+	}
+}
+
+func TestChunkValues(t *testing.T) {
+	bitsValue := func(b uint64) float64 { return math.Float64frombits(b) }
+	for _, c := range []struct {
+		name string
+		vs   []float64
+	}{
+		{"same", []float64{1, 1, 1}},
+		{"within previous window", []float64{1, 2, 3, 2}},
+		{"64 meaningful bits", []float64{0, bitsValue(1<<63 | 1), 0}},
+		{"leading zeros clamped", []float64{0, bitsValue(1<<20 | 1), bitsValue(1 << 20), 0}},
+		{"special", []float64{math.NaN(), 1, math.Inf(1), math.Inf(-1), math.NaN(), math.Inf(-1), 0}},
+		{"negative", []float64{-1.5, 1.5, -1e300, 1e-300, math.Copysign(0, -1)}},
+	} {
+		ps := make([]point, len(c.vs))
+		for i, v := range c.vs {
+			ps[i] = point{int64(i) * 10000, v}
+		}
+		roundTrip(t, c.name, ps)
+	}
+}
+
+func TestChunkFull(t *testing.T) {
+	ps := make([]point, chunkPoints)
+	ts := int64(0)
+	for i := range ps {
+		ts += int64(10000 + (i*7919)%5000 - 2500)
+		ps[i] = point{ts, math.Sin(float64(i)) * 1000}
+	}
+	c := roundTrip(t, "full", ps)
+	if !c.full() {
+		t.Errorf("chunk with %d points is not full", c.n)
+	}
+}
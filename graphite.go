@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsd-vis also implements the parts of the Graphite HTTP API that the
+// Graphite datasource of Grafana uses:
+//
+//	/render?target=a.b.*&from=-1h&until=now&format=json
+//	/metrics/find?query=a.b.*
+//
+// Targets and queries are globs on the dotted names: "*" matches any part of a
+// node, "?" any character, "[abc]" any of the characters and "{x,y}" any of
+// the alternatives. Graphite functions are not supported, except for
+// constantLine(), which Grafana uses to test the datasource. Series with tags
+// are rendered with their tags, like "a.b;env=prod", which is how Graphite
+// names tagged series.
+
+type graphiteSeries struct {
+	Target     string           `json:"target"`
+	Datapoints [][2]interface{} `json:"datapoints"`
+}
+
+type graphiteNode struct {
+	Text          string            `json:"text"`
+	ID            string            `json:"id"`
+	Leaf          int               `json:"leaf"`
+	Expandable    int               `json:"expandable"`
+	AllowChildren int               `json:"allowChildren"`
+	Context       map[string]string `json:"context"`
+}
+
+var constantLine = regexp.MustCompile(`^constantLine\(\s*(-?[0-9.eE+-]+)\s*\)$`)
+
+func handleRender(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if f := r.Form.Get("format"); len(f) > 0 && f != "json" {
+		http.Error(w, "only format=json is supported", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	from, err := parseGraphiteTime(r.Form.Get("from"), now.Add(-24*time.Hour), now)
+	if err != nil {
+		http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseGraphiteTime(r.Form.Get("until"), now, now)
+	if err != nil {
+		http.Error(w, "invalid until: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	out := []graphiteSeries{}
+	for _, target := range r.Form["target"] {
+		if m := constantLine.FindStringSubmatch(target); m != nil {
+			v, _ := strconv.ParseFloat(m[1], 64)
+			out = append(out, graphiteSeries{
+				Target: target,
+				Datapoints: [][2]interface{}{
+					{v, from.Unix()}, {v, (from.Unix() + until.Unix()) / 2}, {v, until.Unix()},
+				},
+			})
+			continue
+		}
+		re, err := globRegexp(target)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid target %q: %v", target, err), http.StatusBadRequest)
+			return
+		}
+		metrics := findGlob(re)
+		_, ts, vs := data.Query(metrics, from, until)
+		for i, n := range metrics {
+			s := graphiteSeries{Target: n, Datapoints: make([][2]interface{}, len(ts[i]))}
+			for j, t := range ts[i] {
+				var v interface{}
+				if !math.IsNaN(vs[i][j]) {
+					v = vs[i][j]
+				}
+				s.Datapoints[j] = [2]interface{}{v, t / 1000}
+			}
+			out = append(out, s)
+		}
+	}
+	graphiteReply(w, out)
+}
+
+func handleFind(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+	if len(query) == 0 {
+		http.Error(w, "missing query", http.StatusBadRequest)
+		return
+	}
+	parts := strings.Split(query, ".")
+	res := make([]*regexp.Regexp, len(parts))
+	for i, p := range parts {
+		var err error
+		if res[i], err = globRegexp(p); err != nil {
+			http.Error(w, fmt.Sprintf("invalid query %q: %v", query, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// the nodes at the level of the query, as a leaf and as a branch
+	leaves := make(map[string]bool)
+	branches := make(map[string]bool)
+	names.Lock()
+	for key := range names.Names {
+		name, _ := splitSeries(key)
+		nodes := strings.Split(name, ".")
+		if len(nodes) < len(parts) {
+			continue
+		}
+		match := true
+		for i, re := range res {
+			if !re.MatchString(nodes[i]) {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		id := strings.Join(nodes[:len(parts)], ".")
+		if len(nodes) == len(parts) {
+			leaves[id] = true
+		} else {
+			branches[id] = true
+		}
+	}
+	names.Unlock()
+
+	out := []graphiteNode{}
+	for id := range branches {
+		out = append(out, graphiteNode{ID: id, Text: id[strings.LastIndex(id, ".")+1:],
+			Expandable: 1, AllowChildren: 1, Context: map[string]string{}})
+	}
+	for id := range leaves {
+		out = append(out, graphiteNode{ID: id, Text: id[strings.LastIndex(id, ".")+1:],
+			Leaf: 1, Context: map[string]string{}})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ID != out[j].ID {
+			return out[i].ID < out[j].ID
+		}
+		return out[i].Leaf < out[j].Leaf
+	})
+	graphiteReply(w, out)
+}
+
+// findGlob returns the series whose names, without the tags, match re.
+func findGlob(re *regexp.Regexp) (out []string) {
+	names.Lock()
+	for key := range names.Names {
+		if name, _ := splitSeries(key); re.MatchString(name) {
+			out = append(out, key)
+		}
+	}
+	names.Unlock()
+	sort.Strings(out)
+	return
+}
+
+// globRegexp compiles a glob on dotted names into a regular expression that
+// matches whole names.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	inAlt := false
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(`[^.]*`)
+		case '?':
+			b.WriteString(`[^.]`)
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [")
+			}
+			b.WriteString(glob[i : i+end+1])
+			i += end
+		case '{':
+			if inAlt {
+				return nil, fmt.Errorf("nested {")
+			}
+			inAlt = true
+			b.WriteString("(?:")
+		case '}':
+			if !inAlt {
+				return nil, fmt.Errorf("unexpected }")
+			}
+			inAlt = false
+			b.WriteString(")")
+		case ',':
+			if inAlt {
+				b.WriteString("|")
+			} else {
+				b.WriteString(",")
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if inAlt {
+		return nil, fmt.Errorf("unterminated {")
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// graphiteUnits are the units of relative times in Graphite, which match
+// units starting with them, like "min", "mins" or "minutes".
+var graphiteUnits = []struct {
+	prefix string
+	unit   time.Duration
+}{
+	{"s", time.Second},
+	{"min", time.Minute},
+	{"h", time.Hour},
+	{"d", 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"mon", 30 * 24 * time.Hour},
+	{"y", 365 * 24 * time.Hour},
+}
+
+// parseGraphiteTime parses a from or until parameter, which is def if empty.
+// It can be "now", a time relative to now like "-1h" or "-10min", a Unix time
+// in seconds, or an absolute time like "14:30_20171018" or "20171018".
+func parseGraphiteTime(s string, def, now time.Time) (time.Time, error) {
+	switch {
+	case len(s) == 0:
+		return def, nil
+	case s == "now":
+		return now, nil
+	case s[0] == '-' || s[0] == '+':
+		i := 1
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		n, err := strconv.Atoi(s[1:i])
+		if err != nil {
+			return now, fmt.Errorf("invalid relative time %q", s)
+		}
+		unit := s[i:]
+		for _, u := range graphiteUnits {
+			if strings.HasPrefix(unit, u.prefix) {
+				d := time.Duration(n) * u.unit
+				if s[0] == '-' {
+					d = -d
+				}
+				return now.Add(d), nil
+			}
+		}
+		return now, fmt.Errorf("invalid unit in relative time %q", s)
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil && len(s) != 8 {
+		return time.Unix(secs, 0), nil
+	}
+	for _, layout := range []string{"15:04_20060102", "20060102"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return now, fmt.Errorf("invalid time %q", s)
+}
+
+func graphiteReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	// Grafana may be served from another origin
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// histogramConfig is the Etsy statsd style histogram setting for timers whose
+// name contains the pattern. The counts of values less than each bin upper
+// bound (and not counted in an earlier bin) are generated as metrics like
+// "my.timer.histogram.bin_100", with "inf" as the catch-all last bin.
+type histogramConfig struct {
+	pattern string
+	bins    []float64
+	labels  []string
+}
+
+// histograms parses the histogram setting, which is a ";" separated list of
+// "pattern=bin,bin,..", like "api.=10,50,100,inf;=1000,inf". The first entry
+// whose pattern is contained in the timer name applies to that timer.
+func histograms(s string) (r []histogramConfig) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return
+	}
+	for _, entry := range strings.Split(s, ";") {
+		pos := strings.Index(entry, "=")
+		if pos == -1 {
+			log.Fatalf("invalid histogram setting %q, must be pattern=bin,bin,..", entry)
+		}
+		h := histogramConfig{pattern: strings.TrimSpace(entry[:pos])}
+		for _, b := range strings.Split(entry[pos+1:], ",") {
+			b = strings.TrimSpace(b)
+			v := math.Inf(+1)
+			if b != "inf" {
+				var err error
+				if v, err = strconv.ParseFloat(b, 64); err != nil {
+					log.Fatalf("invalid histogram bin %q: %v", b, err)
+				}
+			}
+			if n := len(h.bins); n > 0 && v <= h.bins[n-1] {
+				log.Fatalf("invalid histogram bins %q, must be in ascending order", entry[pos+1:])
+			}
+			h.bins = append(h.bins, v)
+			h.labels = append(h.labels, "bin_"+strings.Replace(b, ".", "_", -1))
+		}
+		r = append(r, h)
+	}
+	return
+}
+
+// findHistogram returns the histogram setting for the timer series key, or
+// nil if there is none.
+func findHistogram(key string) *histogramConfig {
+	name, _ := splitSeries(key)
+	for i := range config.histograms {
+		if strings.Contains(name, config.histograms[i].pattern) {
+			return &config.histograms[i]
+		}
+	}
+	return nil
+}
+
+// flushHistogram adds the histogram bin counts of the sorted values of the
+// timer series bucket to the result.
+func flushHistogram(result *Stats, bucket string, values []float64) {
+	h := findHistogram(bucket)
+	if h == nil {
+		return
+	}
+	i := 0
+	for b, bound := range h.bins {
+		freq := 0
+		for ; i < len(values) && values[i] < bound; i++ {
+			freq++
+		}
+		addGen(result, bucket, ".histogram."+h.labels[b], float64(freq))
+	}
+}
+
+// histogramBin returns the series the histogram bin metric was generated from
+// and the upper bound of the bin, or ok=false if it is not a bin metric.
+func histogramBin(key string) (series string, bound float64, ok bool) {
+	name, tags := splitSeries(key)
+	pos := strings.LastIndex(name, ".histogram.bin_")
+	if pos == -1 {
+		return
+	}
+	b := name[pos+len(".histogram.bin_"):]
+	if b == "inf" {
+		bound = math.Inf(+1)
+	} else if v, err := strconv.ParseFloat(strings.Replace(b, "_", ".", -1), 64); err == nil {
+		bound = v
+	} else {
+		return
+	}
+	return name[:pos] + tags, bound, true
+}
+
+// heatmapBins checks if all the metrics are histogram bins, and if so returns
+// them grouped by the series they were generated from, in the order of the
+// series. The bins in each group are sorted, with their labels.
+func heatmapBins(metrics []string) (series []string, groups, labels [][]string, ok bool) {
+	if len(metrics) == 0 {
+		return
+	}
+	bounds := make(map[string]float64)
+	index := make(map[string]int)
+	for _, m := range metrics {
+		s, bound, isBin := histogramBin(m)
+		if !isBin {
+			return nil, nil, nil, false
+		}
+		bounds[m] = bound
+		if _, found := index[s]; !found {
+			index[s] = len(series)
+			series = append(series, s)
+			groups = append(groups, nil)
+		}
+		groups[index[s]] = append(groups[index[s]], m)
+	}
+	sort.Strings(series)
+	for _, s := range series {
+		group := groups[index[s]]
+		sort.Slice(group, func(i, j int) bool {
+			return bounds[group[i]] < bounds[group[j]]
+		})
+		var l []string
+		for _, m := range group {
+			if math.IsInf(bounds[m], +1) {
+				l = append(l, "inf")
+			} else {
+				l = append(l, strconv.FormatFloat(bounds[m], 'f', -1, 64))
+			}
+		}
+		labels = append(labels, l)
+	}
+	sorted := make([][]string, len(series))
+	for i, s := range series {
+		sorted[i] = groups[index[s]]
+	}
+	return series, sorted, labels, true
+}
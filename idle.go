@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Idle policies decide what is sent for a series in a flush in which it did
+// not receive any values. These correspond to the deleteCounters,
+// deleteTimers, deleteSets and deleteGauges settings of Etsy statsd.
+const (
+	idleNone = iota // send nothing
+	idleZero        // send zero
+	idleLast        // send the last value again
+)
+
+var idlePolicyNames = []string{"none", "zero", "last"}
+
+func idlePolicy(s string) int {
+	for i, n := range idlePolicyNames {
+		if s == n {
+			return i
+		}
+	}
+	log.Fatalf("invalid idle policy %q, must be one of none, zero or last", s)
+	return idleNone
+}
+
+// seriesInfo is what the aggregator remembers about a series across flushes,
+// to apply the idle policy of its type once it stops receiving values.
+type seriesInfo struct {
+	typ   int
+	at    time.Time // last flush in which the series had values
+	value float64   // last value of counters and sets
+	tinfo timerInfo // last values of timers, if the idle policy is "last"
+}
+
+// markSeen records that the series had values in the flush at now.
+func (h *HoldingArea) markSeen(key string, typ int, now time.Time) *seriesInfo {
+	si, ok := h.seen[key]
+	if !ok {
+		si = &seriesInfo{typ: typ}
+		h.seen[key] = si
+	}
+	si.at = now
+	return si
+}
+
+func (si *seriesInfo) keepTimer(tinfo timerInfo) {
+	if config.idleTimers == idleLast {
+		si.tinfo = tinfo
+	}
+}
+
+// flushIdle applies the idle policies to the series which had values in an
+// earlier flush but not in this one, and forgets the series that have been
+// idle for longer than the idle TTL, returning their names.
+func (h *HoldingArea) flushIdle(result *Stats, now time.Time) (expired []string) {
+	for key, si := range h.seen {
+		if !si.at.Before(now) {
+			continue
+		}
+		if config.idleTTL > 0 && now.Sub(si.at) > config.idleTTL {
+			delete(h.seen, key)
+			expired = append(expired, key)
+			continue
+		}
+		switch si.typ {
+		case mtCounter:
+			if config.idleCounters == idleZero {
+				result.add(key, 0)
+				addGen(result, key, ".rate", 0)
+			} else if config.idleCounters == idleLast {
+				result.add(key, si.value)
+				addGen(result, key, ".rate", si.value/config.flush.Seconds())
+			}
+		case mtSet:
+			if config.idleSets == idleZero {
+				result.add(key, 0)
+			} else if config.idleSets == idleLast {
+				result.add(key, si.value)
+			}
+		case mtTimer, mtHistogram, mtDistribution:
+			if config.idleTimers == idleZero {
+				addTimerStat(result, key, "count", ".count", 0)
+				addTimerStat(result, key, "count_ps", ".count_ps", 0)
+			} else if config.idleTimers == idleLast {
+				flushTimer(result, key, si.tinfo)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics about statsd-vis itself are recorded under this prefix, and go
+// through the same aggregation and flush as the metrics received. Incoming
+// metrics with this prefix are rejected.
+const internalPrefix = "statsd-vis."
+
+// The counters below are updated atomically by the listeners, and their
+// values since the last flush are recorded into the holding area at the next
+// flush.
+var (
+	packetsReceived uint64 // datagrams received over udp and unixgram
+	linesParsed     uint64 // lines accepted
+	badLines        [badLineKinds]uint64
+	mappingDropped  uint64 // values dropped by mapping rules
+	opsDropped      uint64 // values dropped because the queue was full
+	opsDroppedTotal uint64 // values dropped since startup
+	tcpOpen         int64  // open tcp connections
+	unixOpen        int64  // open unix stream connections
+)
+
+// These are owned by the aggregator.
+var (
+	lastOverflows     uint64 // udp receive buffer overflows as of the last flush
+	lastFlushMetrics  int
+	lastFlushDuration time.Duration
+)
+
+func countPacket() {
+	atomic.AddUint64(&packetsReceived, 1)
+}
+
+func countLine() {
+	atomic.AddUint64(&linesParsed, 1)
+}
+
+func countBadLine(bad int) {
+	atomic.AddUint64(&badLines[bad], 1)
+}
+
+func countMappingDrop() {
+	atomic.AddUint64(&mappingDropped, 1)
+}
+
+// dropOp counts a value dropped because the queue was full.
+func dropOp() {
+	atomic.AddUint64(&opsDropped, 1)
+	atomic.AddUint64(&opsDroppedTotal, 1)
+}
+
+// flushed records the number of metrics and the time taken by a flush.
+func flushed(metrics int, took time.Duration) {
+	lastFlushMetrics = metrics
+	lastFlushDuration = took
+}
+
+// recordInternal adds the internal metrics to the holding area. It is called
+// from the aggregator of the first shard just before a flush.
+func recordInternal(h *HoldingArea, now time.Time) {
+	counter := func(name string, v uint64) {
+		h.counters[internalPrefix+name] = int64(v)
+	}
+	gauge := func(name string, v int64) {
+		h.gauges[internalPrefix+name] = v
+		h.gaugesAt[internalPrefix+name] = now
+	}
+	counter("packets_received", atomic.SwapUint64(&packetsReceived, 0))
+	counter("lines_parsed", atomic.SwapUint64(&linesParsed, 0))
+	for bad := 1; bad < badLineKinds; bad++ {
+		if n := atomic.SwapUint64(&badLines[bad], 0); n > 0 {
+			counter("bad_lines."+badLineName(bad), n)
+		}
+	}
+	counter("queue.dropped", atomic.SwapUint64(&opsDropped, 0))
+	if config.mapIngest {
+		counter("mapping.dropped", atomic.SwapUint64(&mappingDropped, 0))
+	}
+	if len(carbonServers) > 0 {
+		counter("carbon.sent", atomic.SwapUint64(&carbonSent, 0))
+		counter("carbon.dropped", atomic.SwapUint64(&carbonDropped, 0))
+		gauge("carbon.buffered", int64(carbonBuffered()))
+	}
+	depth, _ := queueDepth()
+	gauge("queue.depth", int64(depth))
+	overflows := udpOverflowCount()
+	counter("udp.rcvbuf_overflows", overflows-lastOverflows)
+	lastOverflows = overflows
+	gauge("tcp.connections", atomic.LoadInt64(&tcpOpen))
+	if unixLis != nil {
+		gauge("unix.connections", atomic.LoadInt64(&unixOpen))
+	}
+	if limited() {
+		gauge("limits.series", int64(seriesCount()))
+		counter("limits.rejected", atomic.SwapUint64(&seriesRejected, 0))
+		counter("limits.evicted", atomic.SwapUint64(&seriesEvicted, 0))
+	}
+	if !h.lastFlush.IsZero() {
+		gauge("flush.metrics", int64(lastFlushMetrics))
+		gauge("flush.duration_us", int64(lastFlushDuration/time.Microsecond))
+	}
+}
+
+// udpOverflowCount returns the number of datagrams dropped by the kernel so
+// far because the receive buffer of a UDP socket was full.
+func udpOverflowCount() (n uint64) {
+	for _, sock := range udpSockets {
+		n += uint64(atomic.LoadUint32(&sock.overflows))
+	}
+	return
+}
+
+// queueStatus describes the state of the queue for the web UI.
+func queueStatus() string {
+	depth, capacity := queueDepth()
+	return fmt.Sprintf("queue: %d of %d used, %d values dropped, %d UDP receive buffer overflows",
+		depth, capacity, atomic.LoadUint64(&opsDroppedTotal), udpOverflowCount())
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The number of series and the memory used by the stored values can be
+// limited. Once a limit is reached, the limit policy decides what happens to
+// new series: they are rejected, or the least recently updated series are
+// evicted to make room for them. Evicted series are forgotten entirely, as if
+// they had expired.
+//
+// Series that are not updated are counted until they expire by the gauge
+// expiry or the idle TTL, so with the reject policy, set an idle TTL to make
+// room for new series over time.
+
+const (
+	limitReject = iota // reject new series
+	limitEvict         // evict the least recently updated series
+)
+
+var limitPolicyNames = []string{"reject", "evict"}
+
+func limitMode(s string) int {
+	for i, n := range limitPolicyNames {
+		if s == n {
+			return i
+		}
+	}
+	log.Fatalf("invalid limit policy %q, must be reject or evict", s)
+	return limitReject
+}
+
+const (
+	maxRejectedShown = 1000 // rejected series listed in the web UI
+	recentEvictions  = 100  // evicted series listed in the web UI
+)
+
+// seriesUse is when a series was last updated. It is the value of an element
+// in the LRU list.
+type seriesUse struct {
+	key string
+	at  time.Time
+}
+
+type rejectedSeries struct {
+	Series string
+	Reason string
+	Count  uint64
+	Last   time.Time
+}
+
+type evictedSeries struct {
+	At     time.Time
+	Series string
+	Reason string
+}
+
+var limits struct {
+	sync.Mutex
+	series     map[string]*list.Element
+	lru        list.List // most recently updated first
+	overBudget bool      // the store used more than the memory limit at the last flush
+	storeBytes int
+	rejected   map[string]*rejectedSeries
+	evicted    [recentEvictions]evictedSeries
+	next       int        // index in evicted for the next eviction
+	evictedFor [][]string // evicted series to be forgotten by each shard
+}
+
+var (
+	seriesRejected      uint64 // values of rejected series since the last flush
+	seriesEvicted       uint64 // series evicted since the last flush
+	seriesRejectedTotal uint64
+	seriesEvictedTotal  uint64
+)
+
+// limited checks if there are any limits.
+func limited() bool {
+	return config.maxSeries > 0 || config.maxMemory > 0
+}
+
+func startLimits() {
+	limits.series = make(map[string]*list.Element)
+	limits.rejected = make(map[string]*rejectedSeries)
+	limits.evictedFor = make([][]string, len(shards))
+}
+
+// admitSeries checks if a series that is not in the holding area can be
+// updated, adding it to the known series if it is new. It is called from the
+// aggregators.
+func admitSeries(key string) bool {
+	limits.Lock()
+	if _, ok := limits.series[key]; ok {
+		limits.Unlock()
+		return true
+	}
+	reason := ""
+	if limits.overBudget {
+		reason = "memory limit"
+	} else if config.maxSeries > 0 && len(limits.series) >= config.maxSeries {
+		reason = "series limit"
+	}
+	var evicted []string
+	if len(reason) > 0 && config.limitPolicy == limitEvict {
+		if e := limits.lru.Back(); e != nil {
+			evicted = append(evicted, evictLocked(e, reason))
+			reason = ""
+		}
+	}
+	if len(reason) > 0 {
+		rejectLocked(key, reason)
+		limits.Unlock()
+		atomic.AddUint64(&seriesRejected, 1)
+		atomic.AddUint64(&seriesRejectedTotal, 1)
+		return false
+	}
+	limits.series[key] = limits.lru.PushFront(&seriesUse{key: key, at: time.Now()})
+	limits.Unlock()
+	forgetEvicted(evicted)
+	return true
+}
+
+func rejectLocked(key, reason string) {
+	rs, ok := limits.rejected[key]
+	if !ok {
+		if len(limits.rejected) >= maxRejectedShown {
+			return
+		}
+		rs = &rejectedSeries{Series: key}
+		limits.rejected[key] = rs
+	}
+	rs.Reason = reason
+	rs.Count++
+	rs.Last = time.Now()
+}
+
+// evictLocked removes the series of the LRU list element from the known
+// series, and queues it to be forgotten by its shard.
+func evictLocked(e *list.Element, reason string) string {
+	key := e.Value.(*seriesUse).key
+	limits.lru.Remove(e)
+	delete(limits.series, key)
+	limits.evicted[limits.next] = evictedSeries{At: time.Now(), Series: key, Reason: reason}
+	limits.next = (limits.next + 1) % recentEvictions
+	i := seriesShard(splitSeries(key))
+	limits.evictedFor[i] = append(limits.evictedFor[i], key)
+	atomic.StoreInt32(&shards[i].evicted, 1)
+	atomic.AddUint64(&seriesEvicted, 1)
+	atomic.AddUint64(&seriesEvictedTotal, 1)
+	return key
+}
+
+// forgetEvicted removes evicted series, and the names generated from them,
+// from the metric names and the store. Their shards remove them from their
+// holding areas before they apply the next value or flush.
+func forgetEvicted(keys []string) {
+	if len(keys) > 0 {
+		data.Remove(names.WithGens(keys))
+		names.Remove(keys)
+	}
+}
+
+// takeEvicted returns the series evicted since the last call, for the shard
+// to forget, except for those that have been admitted again since.
+func takeEvicted(shard int) (keys []string) {
+	limits.Lock()
+	for _, key := range limits.evictedFor[shard] {
+		if _, ok := limits.series[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	limits.evictedFor[shard] = nil
+	limits.Unlock()
+	return
+}
+
+// dropEvicted removes the series of the shard evicted since the last call
+// from its holding area. It is called from the aggregator before it applies a
+// value or flushes, so that values received after an eviction go through
+// admitSeries again. The series are also removed from the names and the store
+// again, in case a flush stored them while they were being evicted.
+func (sh *shard) dropEvicted() {
+	atomic.StoreInt32(&sh.evicted, 0)
+	keys := takeEvicted(sh.index)
+	sh.area.forget(keys)
+	forgetEvicted(keys)
+}
+
+// touchSeries records that the series were updated at now.
+func touchSeries(keys []string, now time.Time) {
+	limits.Lock()
+	for _, key := range keys {
+		if e, ok := limits.series[key]; ok {
+			e.Value.(*seriesUse).at = now
+			limits.lru.MoveToFront(e)
+		}
+	}
+	limits.Unlock()
+}
+
+// dropSeries forgets the series that have expired.
+func dropSeries(keys []string) {
+	limits.Lock()
+	for _, key := range keys {
+		if e, ok := limits.series[key]; ok {
+			limits.lru.Remove(e)
+			delete(limits.series, key)
+		}
+	}
+	limits.Unlock()
+}
+
+// holds checks if the holding area has the series of the operation, which
+// then has been admitted already.
+func (h *HoldingArea) holds(op int, key string) (ok bool) {
+	switch op {
+	case SDOP_C_ADD:
+		_, ok = h.counters[key]
+	case SDOP_T:
+		_, ok = h.timers[key]
+	case SDOP_H:
+		_, ok = h.histograms[key]
+	case SDOP_D:
+		_, ok = h.distributions[key]
+	case SDOP_G_SET, SDOP_G_INCR, SDOP_G_DECR:
+		_, ok = h.gauges[key]
+	case SDOP_S:
+		_, ok = h.sets[key]
+	}
+	return
+}
+
+// updated returns the series that received values since the last flush.
+func (h *HoldingArea) updated() (keys []string) {
+	for _, m := range []map[string]timerInfo{h.timers, h.histograms, h.distributions} {
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	for key := range h.counters {
+		keys = append(keys, key)
+	}
+	for key := range h.sets {
+		keys = append(keys, key)
+	}
+	for key, at := range h.gaugesAt {
+		if at.After(h.lastFlush) {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// forget removes evicted series from the holding area.
+func (h *HoldingArea) forget(keys []string) {
+	for _, key := range keys {
+		delete(h.counters, key)
+		delete(h.timers, key)
+		delete(h.histograms, key)
+		delete(h.distributions, key)
+		delete(h.gauges, key)
+		delete(h.gaugesAt, key)
+		delete(h.sets, key)
+		delete(h.seen, key)
+	}
+}
+
+// enforceMemory checks the memory used by the store after a flush. If it is
+// over the limit, either new series are rejected until it is not, or the
+// least recently updated series are evicted to bring it under the limit.
+func enforceMemory() {
+	if config.maxMemory <= 0 {
+		return
+	}
+	size := make(map[string]int)
+	total := 0
+	for _, m := range data.Memory() {
+		size[m.Name] = m.Bytes
+		total += m.Bytes
+	}
+	var evicted []string
+	limits.Lock()
+	if config.limitPolicy == limitEvict {
+		for total > config.maxMemory && limits.lru.Len() > 0 {
+			key := evictLocked(limits.lru.Back(), "memory limit")
+			evicted = append(evicted, key)
+			for _, n := range names.WithGens([]string{key}) {
+				total -= size[n]
+			}
+		}
+	}
+	limits.storeBytes = total
+	limits.overBudget = total > config.maxMemory
+	limits.Unlock()
+	forgetEvicted(evicted)
+}
+
+type dataLimits struct {
+	Series         int
+	MaxSeries      int
+	StoreBytes     int
+	MaxBytes       int
+	Policy         string
+	RejectedTotal  uint64
+	EvictedTotal   uint64
+	Rejected       []rejectedSeries
+	RejectedCapped bool
+	Evicted        []evictedSeries
+	ListPath       string
+}
+
+// limitsReport returns the limits, the rejected series with the latest
+// first, and the recently evicted series with the latest first.
+func limitsReport() (r dataLimits) {
+	limits.Lock()
+	defer limits.Unlock()
+	r.Series = len(limits.series)
+	r.MaxSeries = config.maxSeries
+	r.StoreBytes = limits.storeBytes
+	r.MaxBytes = config.maxMemory
+	r.Policy = limitPolicyNames[config.limitPolicy]
+	r.RejectedTotal = atomic.LoadUint64(&seriesRejectedTotal)
+	r.EvictedTotal = atomic.LoadUint64(&seriesEvictedTotal)
+	for _, rs := range limits.rejected {
+		r.Rejected = append(r.Rejected, *rs)
+	}
+	r.RejectedCapped = len(limits.rejected) >= maxRejectedShown
+	sort.Slice(r.Rejected, func(i, j int) bool {
+		return r.Rejected[i].Last.After(r.Rejected[j].Last)
+	})
+	for i := 1; i <= recentEvictions; i++ {
+		e := limits.evicted[(limits.next-i+recentEvictions)%recentEvictions]
+		if e.At.IsZero() {
+			break
+		}
+		r.Evicted = append(r.Evicted, e)
+	}
+	return
+}
+
+// seriesCount returns the number of series counted against the limits.
+func seriesCount() int {
+	limits.Lock()
+	defer limits.Unlock()
+	return len(limits.series)
+}
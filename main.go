@@ -16,33 +16,116 @@ import (
 const Version = "0.1"
 
 type configType struct {
-	webUI       string
-	statsdUDP   string
-	statsdTCP   string
-	flush       time.Duration
-	percentiles []int
-	retention   time.Duration
+	webUI          string
+	statsdUDP      string
+	statsdTCP      string
+	statsdUnixgram string
+	statsdUnix     string
+	udpReaders     int
+	udpReusePort   bool
+	udpRcvbuf      int
+	maxDatagram    int
+	flush          time.Duration
+	percentiles    []int
+	timerStats     map[string]bool
+	histograms     []histogramConfig
+	retention      time.Duration
+	rollups        []rollupConfig
+	dataDir        string
+	snapshot       time.Duration
+	queueLen       int
+	queueDrop      bool
+	badLineLog     int
+	shards         int
+	maxSeries      int
+	maxMemory      int
+	limitPolicy    int
+	mapping        string
+	mapIngest      bool
+	carbon         string
+	carbonPrefix   string
+	carbonBuffer   int
+	gaugeExpiry    time.Duration
+	idleCounters   int
+	idleTimers     int
+	idleGauges     int
+	idleSets       int
+	idleTTL        time.Duration
 }
 
 // config contains the configurable parameters, initialized with default values.
 var config = configType{
-	webUI:       "0.0.0.0:8080",
-	statsdUDP:   "127.0.0.1:8125",
-	statsdTCP:   "127.0.0.1:8125",
-	flush:       10 * time.Second,
-	percentiles: []int{90, 95, 99},
-	retention:   30 * time.Minute,
+	webUI:        "0.0.0.0:8080",
+	statsdUDP:    "127.0.0.1:8125",
+	statsdTCP:    "127.0.0.1:8125",
+	udpReaders:   1,
+	udpReusePort: false,
+	udpRcvbuf:    0,
+	maxDatagram:  16384,
+	flush:        10 * time.Second,
+	percentiles:  []int{90, 95, 99},
+	timerStats:   stringset(defaultTimerStats),
+	retention:    30 * time.Minute,
+	dataDir:      "",
+	snapshot:     time.Minute,
+	queueLen:     1000,
+	queueDrop:    false,
+	badLineLog:   badLogSampled,
+	shards:       1,
+	maxSeries:    0,
+	maxMemory:    0,
+	limitPolicy:  limitReject,
+	mapping:      "",
+	mapIngest:    false,
+	carbon:       "",
+	carbonPrefix: "",
+	carbonBuffer: 100000,
+	gaugeExpiry:  0,
+	idleCounters: idleNone,
+	idleTimers:   idleNone,
+	idleGauges:   idleLast,
+	idleSets:     idleNone,
+	idleTTL:      0,
 }
 
 var (
-	data        *StatsRing
-	names       = NewMetricNames()
-	webUI       = flag.String("webui", config.webUI, "web UI listen `address`")
-	statsdUDP   = flag.String("statsdudp", config.statsdUDP, "statsd UDP listen `address`")
-	statsdTCP   = flag.String("statsdtcp", config.statsdTCP, "statsd TCP listen `address`")
-	flush       = flag.Duration("flush", config.flush, "flush `interval`")
-	percentiles = flag.String("percentiles", "90,95,99", "percentiles for timer metrics")
-	retention   = flag.Duration("retention", config.retention, "`duration` to retain the metrics for")
+	data           *SeriesStore
+	names          = NewMetricNames()
+	webUI          = flag.String("webui", config.webUI, "web UI listen `address`")
+	statsdUDP      = flag.String("statsdudp", config.statsdUDP, "statsd UDP listen `address`")
+	statsdTCP      = flag.String("statsdtcp", config.statsdTCP, "statsd TCP listen `address`")
+	statsdUnixgram = flag.String("statsdunixgram", config.statsdUnixgram, "statsd unix datagram socket `path`")
+	statsdUnix     = flag.String("statsdunix", config.statsdUnix, "statsd unix stream socket `path`")
+	udpReaders     = flag.Int("udpreaders", config.udpReaders, "number of statsd UDP reader goroutines")
+	udpReusePort   = flag.Bool("udpreuseport", config.udpReusePort, "use a separate SO_REUSEPORT socket for each UDP reader (Linux only)")
+	udpRcvbuf      = flag.Int("udprcvbuf", config.udpRcvbuf, "statsd UDP socket receive buffer `size` in bytes (0 = OS default)")
+	maxDatagram    = flag.Int("maxdatagram", config.maxDatagram, "max `size` in bytes of statsd UDP and unixgram datagrams")
+	flush          = flag.Duration("flush", config.flush, "flush `interval`")
+	percentiles    = flag.String("percentiles", "90,95,99", "percentiles for timer metrics, negative N for stats of the top N% of values")
+	timerStats     = flag.String("timerstats", defaultTimerStats, "timer `stats` to generate, or \"all\"")
+	histogram      = flag.String("histogram", "", "timer histogram `bins` like \"pattern=10,50,100,inf;...\"")
+	retention      = flag.Duration("retention", config.retention, "`duration` to retain the metrics for")
+	rollupsFlag    = flag.String("rollups", "", "coarser `resolutions` to keep values at for longer, like \"1m:1d,10m:30d\"")
+	dataDir        = flag.String("datadir", config.dataDir, "`directory` to save the metrics into and load them from at startup")
+	snapshot       = flag.Duration("snapshot", config.snapshot, "`interval` to save the metrics into the data directory at (0 = only at exit)")
+	queueLen       = flag.Int("queuelen", config.queueLen, "max number of values waiting to be aggregated")
+	queueDrop      = flag.Bool("queuedrop", config.queueDrop, "drop values instead of waiting when the queue is full")
+	badLineLog     = flag.String("badlines", "sampled", "how to log bad lines: log (every one), sampled (at most one a second) or silent")
+	nshards        = flag.Int("shards", config.shards, "number of aggregator goroutines, each with its own queue")
+	maxSeries      = flag.Int("maxseries", config.maxSeries, "max number of series (0 = unlimited)")
+	maxMemory      = flag.Int("maxmemory", config.maxMemory, "max `size` in bytes of the stored values (0 = unlimited)")
+	limitPolicy    = flag.String("limitpolicy", "reject", "what to do with new series over the limits: reject, or evict the least recently updated")
+	mapping        = flag.String("mapping", config.mapping, "JSON `file` with statsd_exporter style rules to map names to Prometheus names and labels")
+	mapIngest      = flag.Bool("mapingest", config.mapIngest, "also apply the mapping rules to the names received, with the labels as tags")
+	carbon         = flag.String("carbon", config.carbon, "comma-separated `addresses` of Carbon servers to forward the flushes to")
+	carbonPrefix   = flag.String("carbonprefix", config.carbonPrefix, "`prefix` for the names forwarded to Carbon, like \"stats.\"")
+	carbonBuffer   = flag.Int("carbonbuffer", config.carbonBuffer, "max number of lines to keep for each Carbon server while it is down")
+	gaugeExpiry    = flag.Duration("gaugeexpiry", config.gaugeExpiry, "remove gauges not updated for this `duration` (0 = never)")
+	idleCounters   = flag.String("idlecounters", "none", "what to send for idle counters: none, zero or last")
+	idleTimers     = flag.String("idletimers", "none", "what to send for idle timers, histograms and distributions: none, zero or last")
+	idleGauges     = flag.String("idlegauges", "last", "what to send for idle gauges: none, zero or last")
+	idleSets       = flag.String("idlesets", "none", "what to send for idle sets: none, zero or last")
+	idleTTL        = flag.Duration("idlettl", config.idleTTL, "forget metrics idle for this `duration` (0 = never)")
 )
 
 func usage() {
@@ -60,8 +143,8 @@ func intarray(s string) (r []int) {
 	for i, p := range parts {
 		if v, err := strconv.Atoi(strings.TrimSpace(p)); err != nil {
 			log.Fatalf("invalid percentiles string: %v", err)
-		} else if v <= 0 || v >= 100 {
-			log.Fatalf("invalid percentile %d, must be > 0 and < 100", v)
+		} else if v == 0 || v <= -100 || v >= 100 {
+			log.Fatalf("invalid percentile %d, must be > -100 and < 100, and not 0", v)
 		} else {
 			r[i] = v
 		}
@@ -73,6 +156,35 @@ func intarray(s string) (r []int) {
 	return
 }
 
+// allTimerStats are the stats that can be generated for timers, where "_N" is
+// a stat for each of the percentiles.
+const allTimerStats = "count,count_ps,lower,mean,median,std,sum,sum_squares,upper," +
+	"count_N,lower_N,mean_N,sum_N,sum_squares_N,upper_N"
+
+const defaultTimerStats = "count,lower,mean,upper,lower_N,upper_N"
+
+func stringset(s string) map[string]bool {
+	r := make(map[string]bool)
+	for _, p := range strings.Split(s, ",") {
+		r[strings.TrimSpace(p)] = true
+	}
+	return r
+}
+
+func timerStatSet(s string) map[string]bool {
+	if s == "all" {
+		s = allTimerStats
+	}
+	r := stringset(s)
+	all := stringset(allTimerStats)
+	for stat, _ := range r {
+		if !all[stat] {
+			log.Fatalf("invalid timer stat %q, must be one of %s", stat, allTimerStats)
+		}
+	}
+	return r
+}
+
 func main() {
 
 	// parse command line
@@ -81,21 +193,92 @@ func main() {
 	config.webUI = *webUI
 	config.statsdUDP = *statsdUDP
 	config.statsdTCP = *statsdTCP
+	config.statsdUnixgram = *statsdUnixgram
+	config.statsdUnix = *statsdUnix
+	config.udpReaders = *udpReaders
+	config.udpReusePort = *udpReusePort
+	config.udpRcvbuf = *udpRcvbuf
+	config.maxDatagram = *maxDatagram
+	if config.udpReaders < 1 {
+		log.Fatalf("invalid number of UDP readers %d", config.udpReaders)
+	}
+	if config.maxDatagram < 1 {
+		log.Fatalf("invalid max datagram size %d", config.maxDatagram)
+	}
 	config.flush = *flush
 	config.percentiles = intarray(*percentiles)
+	config.timerStats = timerStatSet(*timerStats)
+	config.histograms = histograms(*histogram)
 	config.retention = *retention
+	config.rollups = rollups(*rollupsFlag)
+	config.dataDir = *dataDir
+	config.snapshot = *snapshot
+	config.queueLen = *queueLen
+	if config.queueLen < 0 {
+		log.Fatalf("invalid queue length %d", config.queueLen)
+	}
+	config.queueDrop = *queueDrop
+	config.badLineLog = badLogMode(*badLineLog)
+	config.shards = *nshards
+	if config.shards < 1 {
+		log.Fatalf("invalid number of shards %d", config.shards)
+	}
+	config.maxSeries = *maxSeries
+	config.maxMemory = *maxMemory
+	if config.maxSeries < 0 || config.maxMemory < 0 {
+		log.Fatalf("invalid limits %d series, %d bytes", config.maxSeries, config.maxMemory)
+	}
+	config.limitPolicy = limitMode(*limitPolicy)
+	config.mapping = *mapping
+	config.mapIngest = *mapIngest
+	if len(config.mapping) > 0 {
+		var err error
+		if mappings, err = loadMappings(config.mapping); err != nil {
+			log.Fatalf("cannot load mapping rules: %v", err)
+		}
+	} else if config.mapIngest {
+		log.Fatalf("-mapingest needs a -mapping file")
+	}
+	config.carbon = *carbon
+	config.carbonPrefix = *carbonPrefix
+	config.carbonBuffer = *carbonBuffer
+	if config.carbonBuffer < 1 {
+		log.Fatalf("invalid carbon buffer size %d", config.carbonBuffer)
+	}
+	config.gaugeExpiry = *gaugeExpiry
+	config.idleCounters = idlePolicy(*idleCounters)
+	config.idleTimers = idlePolicy(*idleTimers)
+	config.idleGauges = idlePolicy(*idleGauges)
+	config.idleSets = idlePolicy(*idleSets)
+	config.idleTTL = *idleTTL
 
 	// set log flags
 	log.SetPrefix("statsd-vis: ")
 	log.SetFlags(0)
 
 	// start the statsd server
-	data = NewStatsRing(int(config.retention / config.flush))
+	data = NewSeriesStore()
+	if len(config.dataDir) > 0 {
+		startPersist()
+	}
+	if len(config.carbon) > 0 {
+		startCarbon()
+		log.Printf("forwarding to carbon at %s", config.carbon)
+	}
 	startStatsd()
-	log.Printf("statsd UDP server started, listening on %s", config.statsdUDP)
+	log.Printf("statsd UDP server started, listening on %s with %d reader(s)",
+		config.statsdUDP, config.udpReaders)
 	log.Printf("statsd TCP server started, listening on %s", config.statsdTCP)
-	log.Printf("config: flush interval=%v, retention=%v, percentiles=%v",
-		config.flush, config.retention, config.percentiles)
+	if len(config.statsdUnixgram) > 0 {
+		log.Printf("statsd unixgram server started, listening on %s", config.statsdUnixgram)
+	}
+	if len(config.statsdUnix) > 0 {
+		log.Printf("statsd unix server started, listening on %s", config.statsdUnix)
+	}
+	log.Printf("config: flush interval=%v, retention=%v, percentiles=%v, gauge expiry=%v",
+		config.flush, config.retention, config.percentiles, config.gaugeExpiry)
+	log.Printf("config: idle counters=%s, timers=%s, gauges=%s, sets=%s, ttl=%v",
+		*idleCounters, *idleTimers, *idleGauges, *idleSets, config.idleTTL)
 
 	// start the web server
 	go startWeb()
@@ -112,5 +295,9 @@ func main() {
 	}
 	signal.Stop(ch)
 	close(ch)
+	stopStatsd()
+	if len(config.dataDir) > 0 {
+		stopPersist()
+	}
 	log.Print("Bye.")
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Mapping rules turn dotted statsd names into Prometheus style names and
+// labels, like in the mapper of statsd_exporter. They are read from a JSON
+// file with the same fields as the statsd_exporter mapping config:
+//
+//	{"mappings": [
+//	  {"match": "api.*.*.latency", "name": "api_latency",
+//	   "labels": {"service": "$1", "method": "$2"}},
+//	  {"match": "^test\\.(.*)", "match_type": "regex", "action": "drop"}
+//	]}
+//
+// In a glob, each "*" matches one or more characters other than a dot. In a
+// regex, which must match the whole name, the groups are captured. The
+// captures are available as $1, $2 etc. in the name and the labels. The first
+// rule that matches a name applies, and names that no rule matches are left
+// as they are.
+//
+// The rules are applied to the names exposed at /metrics, and with the ingest
+// setting, also to the names received, with the labels added as tags.
+
+type mappingRule struct {
+	Match     string            `json:"match"`
+	MatchType string            `json:"match_type"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Action    string            `json:"action"`
+	re        *regexp.Regexp
+}
+
+var mappings []mappingRule
+
+// loadMappings reads the mapping rules from the file.
+func loadMappings(path string) ([]mappingRule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Mappings []mappingRule `json:"mappings"`
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	for i := range f.Mappings {
+		m := &f.Mappings[i]
+		switch m.MatchType {
+		case "", "glob":
+			parts := strings.Split(m.Match, "*")
+			for j := range parts {
+				parts[j] = regexp.QuoteMeta(parts[j])
+			}
+			m.re, err = regexp.Compile("^" + strings.Join(parts, "([^.]+)") + "$")
+		case "regex":
+			m.re, err = regexp.Compile("^(?:" + m.Match + ")$")
+		default:
+			err = fmt.Errorf("invalid match_type %q, must be glob or regex", m.MatchType)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mapping %d: %v", i+1, err)
+		}
+		switch m.Action {
+		case "", "map":
+			if len(m.Name) == 0 {
+				return nil, fmt.Errorf("mapping %d: missing name", i+1)
+			}
+		case "drop":
+		default:
+			return nil, fmt.Errorf("mapping %d: invalid action %q, must be map or drop", i+1, m.Action)
+		}
+	}
+	return f.Mappings, nil
+}
+
+// mapName applies the first rule that matches the name. It returns the name
+// and labels to use, and whether to drop the metric.
+func mapName(n string) (name string, labels map[string]string, drop bool) {
+	for i := range mappings {
+		m := &mappings[i]
+		match := m.re.FindStringSubmatchIndex(n)
+		if match == nil {
+			continue
+		}
+		if m.Action == "drop" {
+			return n, nil, true
+		}
+		name = string(m.re.ExpandString(nil, m.Name, n, match))
+		if len(m.Labels) > 0 {
+			labels = make(map[string]string, len(m.Labels))
+			for k, v := range m.Labels {
+				labels[k] = string(m.re.ExpandString(nil, v, n, match))
+			}
+		}
+		return name, labels, false
+	}
+	return n, nil, false
+}
+
+// mappedName is the result of mapping a name at ingest, with the labels as a
+// DogStatsD tag list.
+type mappedName struct {
+	name   string
+	labels map[string]string
+	tags   string
+	drop   bool
+}
+
+// mapIngest maps a received name, keeping the result in the parser.
+func (p *lineParser) mapIngest(b []byte) *mappedName {
+	if mn, ok := p.mapped[string(b)]; ok {
+		return mn
+	}
+	if p.mapped == nil || len(p.mapped) >= maxInterned {
+		p.mapped = make(map[string]*mappedName)
+	}
+	name, labels, drop := mapName(string(b))
+	mn := &mappedName{name: name, labels: labels, drop: drop}
+	tags := make([]string, 0, len(labels))
+	for k, v := range labels {
+		tags = append(tags, k+":"+v)
+	}
+	sort.Strings(tags)
+	mn.tags = strings.Join(tags, ",")
+	p.mapped[string(b)] = mn
+	return mn
+}
+
+// appendTags appends the DogStatsD tag list of a line, without the tags that
+// the mapping has labels for, and then the labels, to buf.
+func (mn *mappedName) appendTags(buf, tags []byte) []byte {
+	for len(tags) > 0 {
+		tag := tags
+		if pos := bytes.IndexByte(tags, ','); pos >= 0 {
+			tag, tags = tags[:pos], tags[pos+1:]
+		} else {
+			tags = nil
+		}
+		k := tag
+		if pos := bytes.IndexByte(tag, ':'); pos >= 0 {
+			k = tag[:pos]
+		}
+		if _, ok := mn.labels[string(k)]; !ok {
+			buf = append(append(buf, tag...), ',')
+		}
+	}
+	return append(buf, mn.tags...)
+}
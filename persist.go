@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// If a data directory is configured, the stored series and the metric names are
+// saved into a snapshot file in it periodically and at shutdown, and loaded
+// from it at startup. The file is:
+//
+//	magic "SVSNAP", 6 bytes
+//	format version, 4 bytes big endian
+//	length of the payload, 8 bytes big endian
+//	payload, the gob encoding of a snapshotData
+//	CRC-32 (Castagnoli) of the payload, 4 bytes big endian
+//
+// A snapshot file that cannot be loaded is renamed with a ".bad" suffix and
+// statsd-vis starts without history, instead of refusing to start.
+
+const (
+	snapshotFile    = "statsd-vis.snap"
+	snapshotMagic   = "SVSNAP"
+	snapshotVersion = 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// snapshotLock serializes the saves of the snapshotter and at shutdown, which
+// write the same temporary file.
+var snapshotLock sync.Mutex
+
+type snapshotData struct {
+	Saved  time.Time
+	Values []*Stats // version 1: the flushes, oldest first
+	Series map[string][]chunkData
+	Tiers  []tierData // version 3, with the current intervals since version 4
+	Last   time.Time
+	Names  map[string]int
+	Gens   map[string]map[string]bool
+}
+
+// chunkData is a chunk as it is saved.
+type chunkData struct {
+	B        []byte
+	Nbits    uint
+	N        int
+	First    int64
+	Last     int64
+	Delta    int64
+	Value    uint64
+	Leading  uint8
+	Trailing uint8
+}
+
+// tierData is the chunks of the series of a rollup tier, and the values in
+// its current interval, as they are saved.
+type tierData struct {
+	Res     time.Duration
+	Series  map[string][]chunkData
+	Bucket  int64
+	Pending map[string]rollupData
+}
+
+// rollupData is the values of a series in the current interval of a rollup
+// tier, as they are saved.
+type rollupData struct {
+	Consol int
+	Count  int
+	Sum    float64
+	Min    float64
+	Max    float64
+	Last   float64
+}
+
+// exportPending returns the values in the current interval of the tier.
+func (tr *tier) exportPending() map[string]rollupData {
+	out := make(map[string]rollupData, len(tr.pending))
+	for n, ru := range tr.pending {
+		out[n] = rollupData{Consol: ru.consol, Count: ru.count, Sum: ru.sum,
+			Min: ru.min, Max: ru.max, Last: ru.last}
+	}
+	return out
+}
+
+// restorePending sets the current interval of the tier, unless the tier is
+// already past it.
+func (tr *tier) restorePending(bucket int64, in map[string]rollupData) {
+	if bucket <= tr.bucket {
+		return
+	}
+	tr.closeBucket()
+	tr.bucket = bucket
+	for n, rd := range in {
+		if rd.Count > 0 {
+			tr.pending[n] = &rollup{consol: rd.Consol, count: rd.Count, sum: rd.Sum,
+				min: rd.Min, max: rd.Max, last: rd.Last}
+		}
+	}
+}
+
+// export returns the chunks of all the series in the tier.
+func (tr *tier) export() map[string][]chunkData {
+	out := make(map[string][]chunkData, len(tr.series))
+	for n, sr := range tr.series {
+		cs := make([]chunkData, len(sr.chunks))
+		for i, c := range sr.chunks {
+			cs[i] = chunkData{
+				B:        append([]byte(nil), c.b...),
+				Nbits:    c.nbits,
+				N:        c.n,
+				First:    c.first,
+				Last:     c.last,
+				Delta:    c.delta,
+				Value:    c.value,
+				Leading:  c.leading,
+				Trailing: c.trailing,
+			}
+		}
+		out[n] = cs
+	}
+	return out
+}
+
+// restore adds the chunks of the series, which must not be in the tier.
+func (tr *tier) restore(in map[string][]chunkData) {
+	for n, cs := range in {
+		sr := &series{}
+		for _, cd := range cs {
+			if cd.Nbits > uint(len(cd.B))*8 || cd.N < 1 {
+				continue
+			}
+			sr.chunks = append(sr.chunks, &chunk{
+				b:        cd.B,
+				nbits:    cd.Nbits,
+				n:        cd.N,
+				first:    cd.First,
+				last:     cd.Last,
+				delta:    cd.Delta,
+				value:    cd.Value,
+				leading:  cd.Leading,
+				trailing: cd.Trailing,
+			})
+		}
+		if len(sr.chunks) > 0 {
+			tr.series[n] = sr
+		}
+	}
+	tr.expire(time.Now().Add(-tr.retention))
+}
+
+// export returns the chunks of all the series in the flushed values tier,
+// and in each rollup tier.
+func (r *SeriesStore) export() (series map[string][]chunkData, tiers []tierData, last time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	series = r.tiers[0].export()
+	for _, tr := range r.tiers[1:] {
+		tiers = append(tiers, tierData{Res: tr.res, Series: tr.export(),
+			Bucket: tr.bucket, Pending: tr.exportPending()})
+	}
+	return series, tiers, r.last
+}
+
+// restore adds the chunks of the series in the flushed values tier, and in
+// the rollup tiers with the same resolution as a configured one, with their
+// current intervals.
+func (r *SeriesStore) restore(series map[string][]chunkData, tiers []tierData, last time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	r.tiers[0].restore(series)
+	for _, td := range tiers {
+		for _, tr := range r.tiers[1:] {
+			if tr.res == td.Res {
+				tr.restore(td.Series)
+				tr.restorePending(td.Bucket, td.Pending)
+			}
+		}
+	}
+	if last.After(r.last) {
+		r.last = last
+	}
+}
+
+// copyNames returns copies of the names and the generated names, which can be
+// used without holding the lock.
+func (m *MetricNames) copyNames() (names map[string]int, gens map[string]map[string]bool) {
+	m.Lock()
+	defer m.Unlock()
+	names = make(map[string]int, len(m.Names))
+	for n, t := range m.Names {
+		names[n] = t
+	}
+	gens = make(map[string]map[string]bool, len(m.Gens))
+	for base, g := range m.Gens {
+		c := make(map[string]bool, len(g))
+		for n := range g {
+			c[n] = true
+		}
+		gens[base] = c
+	}
+	return
+}
+
+func snapshotPath() string {
+	return filepath.Join(config.dataDir, snapshotFile)
+}
+
+// saveSnapshot writes the stored series and the metric names into the snapshot
+// file, replacing the earlier one only once the new one is completely
+// written.
+func saveSnapshot() error {
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+	snap := snapshotData{Saved: time.Now()}
+	snap.Series, snap.Tiers, snap.Last = data.export()
+	snap.Names, snap.Gens = names.copyNames()
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(&snap); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(snapshotMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(snapshotVersion))
+	binary.Write(&buf, binary.BigEndian, uint64(payload.Len()))
+	buf.Write(payload.Bytes())
+	binary.Write(&buf, binary.BigEndian, crc32.Checksum(payload.Bytes(), crcTable))
+
+	tmp := snapshotPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf.Bytes()); err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, snapshotPath())
+}
+
+// readSnapshot reads and checks the snapshot file.
+func readSnapshot(path string) (*snapshotData, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	const header = len(snapshotMagic) + 4 + 8
+	if len(b) < header+4 || string(b[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, errors.New("not a snapshot file")
+	}
+	if v := binary.BigEndian.Uint32(b[len(snapshotMagic):]); v < 1 || v > snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot format version %d", v)
+	}
+	n := binary.BigEndian.Uint64(b[len(snapshotMagic)+4:])
+	if n != uint64(len(b)-header-4) {
+		return nil, errors.New("snapshot file is truncated")
+	}
+	payload := b[header : len(b)-4]
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(b[len(b)-4:]) {
+		return nil, errors.New("snapshot file checksum mismatch")
+	}
+	var snap snapshotData
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("snapshot file: %v", err)
+	}
+	return &snap, nil
+}
+
+// loadSnapshot loads the stored series and the metric names from the
+// snapshot file, if there is one. Values older than the retention period are
+// skipped.
+func loadSnapshot() {
+	path := snapshotPath()
+	snap, err := readSnapshot(path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("cannot load snapshot %s: %v, starting without history", path, err)
+		if err := os.Rename(path, path+".bad"); err != nil {
+			log.Printf("cannot rename bad snapshot: %v", err)
+		}
+		return
+	}
+	// version 1 snapshots have the flushes, later ones the series
+	oldest := time.Now().Add(-config.retention)
+	for _, s := range snap.Values {
+		if s != nil && s.At.After(oldest) {
+			if s.Metrics == nil {
+				s.Metrics = make(map[string]float64)
+			}
+			data.Add(s)
+		}
+	}
+	data.restore(snap.Series, snap.Tiers, snap.Last)
+	for n, t := range snap.Names {
+		if t != mtGen {
+			names.Set(n, t)
+		}
+	}
+	for base, g := range snap.Gens {
+		for n := range g {
+			names.AddGen(base, n)
+		}
+	}
+	log.Printf("loaded snapshot %s saved at %v with %d names",
+		path, snap.Saved.Format(time.RFC3339), len(snap.Names))
+}
+
+// snapshotter saves a snapshot at every snapshot interval.
+func snapshotter() {
+	timer := time.NewTicker(config.snapshot)
+	for range timer.C {
+		if err := saveSnapshot(); err != nil {
+			log.Printf("cannot save snapshot: %v", err)
+		}
+	}
+}
+
+// startPersist loads the last snapshot and the write-ahead log from the data
+// directory, creating the directory if needed, and starts saving snapshots
+// periodically.
+func startPersist() {
+	if err := os.MkdirAll(config.dataDir, 0755); err != nil {
+		log.Fatalf("data directory: %v", err)
+	}
+	loadSnapshot()
+	startWAL()
+	if config.snapshot > 0 {
+		go snapshotter()
+	}
+}
+
+// stopPersist saves the final snapshot at shutdown.
+func stopPersist() {
+	if err := saveSnapshot(); err != nil {
+		log.Printf("cannot save snapshot: %v", err)
+	} else {
+		log.Printf("saved snapshot %s", snapshotPath())
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withDataDir sets up an empty series store and metric names, with a data
+// directory for the snapshot, for a test.
+func withDataDir(t *testing.T, rollups string) {
+	withRollups(t, 10*time.Second, 30*time.Minute, rollups)
+	savedData, savedNames := data, names
+	t.Cleanup(func() { data, names = savedData, savedNames })
+	config.dataDir = t.TempDir()
+	data = NewSeriesStore()
+	names = NewMetricNames()
+}
+
+func TestSnapshotRollupInterval(t *testing.T) {
+	withDataDir(t, "1m:1d")
+	names.Set("a", mtCounter)
+	t0 := time.Now().Add(-10 * time.Minute).Truncate(time.Minute)
+	for i := 0; i < 5*6; i++ {
+		if i == 15 {
+			// restart in the middle of the third minute
+			if err := saveSnapshot(); err != nil {
+				t.Fatal(err)
+			}
+			data = NewSeriesStore()
+			loadSnapshot()
+		}
+		data.Add(&Stats{At: t0.Add(time.Duration(i) * 10 * time.Second), Metrics: map[string]float64{"a": 1}})
+	}
+	data.Add(&Stats{At: t0.Add(5 * time.Minute), Metrics: map[string]float64{}})
+
+	_, vs := data.tiers[1].series["a"].points(math.MinInt64, math.MaxInt64)
+	if len(vs) != 5 {
+		t.Fatalf("got %d rollups %v, want 5", len(vs), vs)
+	}
+	for i, v := range vs {
+		if v != 6 {
+			t.Errorf("rollup %d is %v, want 6", i, v)
+		}
+	}
+}
+
+// withSnapshot sets up a data directory with a snapshot of one series, and
+// returns the contents of the snapshot file.
+func withSnapshot(t *testing.T) []byte {
+	withDataDir(t, "")
+	names.Set("a", mtGauge)
+	data.Add(&Stats{At: time.Now(), Metrics: map[string]float64{"a": 1}})
+	if err := saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(snapshotPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSnapshotDamaged(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		damage func(b []byte) []byte
+	}{
+		{"payload", func(b []byte) []byte { b[len(b)/2] ^= 0x40; return b }},
+		{"checksum", func(b []byte) []byte { b[len(b)-1] ^= 1; return b }},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-10] }},
+		{"extended", func(b []byte) []byte { return append(b, 0) }},
+		{"magic", func(b []byte) []byte { b[0] = 'X'; return b }},
+		{"version", func(b []byte) []byte { b[len(snapshotMagic)+3] = snapshotVersion + 1; return b }},
+		{"empty", func(b []byte) []byte { return nil }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			b := withSnapshot(t)
+			if err := ioutil.WriteFile(snapshotPath(), c.damage(b), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readSnapshot(snapshotPath()); err == nil {
+				t.Fatal("damaged snapshot read without error")
+			}
+			data = NewSeriesStore()
+			names = NewMetricNames()
+			loadSnapshot()
+			if _, _, ok := names.Type("a"); ok || !data.Last().IsZero() {
+				t.Error("values loaded from a damaged snapshot")
+			}
+			if _, err := os.Stat(snapshotPath() + ".bad"); err != nil {
+				t.Errorf("damaged snapshot not renamed: %v", err)
+			}
+		})
+	}
+}
+
+func TestSnapshotConcurrentSaves(t *testing.T) {
+	withSnapshot(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := saveSnapshot(); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if _, err := readSnapshot(snapshotPath()); err != nil {
+		t.Error(err)
+	}
+}
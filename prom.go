@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The values of the latest flush are exposed at /metrics in the Prometheus
+// text format, for a Prometheus server to scrape:
+//
+//	counters   as counters named like "my_counter_total", with the total of
+//	           the values flushed since startup
+//	gauges     as gauges
+//	sets       as gauges, with the number of unique values in the last flush
+//	timers     as summaries, with the percentiles as quantiles, and the sum
+//	           and count of the values since startup
+//
+// Names are mapped by the mapping rules, if any, and then sanitized into valid
+// Prometheus names, like "my.counter" into "my_counter". The DogStatsD tags
+// become labels.
+
+// promTotal is the sum of the values of a counter, or the sum and count of the
+// values of a timer, received in a flush or since startup.
+type promTotal struct {
+	sum   float64
+	count float64
+}
+
+// promTotals are the totals of the counters and timers, by series, over all
+// the flushes.
+var promTotals struct {
+	sync.Mutex
+	m map[string]promTotal
+}
+
+// promAccumulate adds the values received in a flush to the totals. Values
+// sent again for idle series are not added. It is called from the flusher.
+func promAccumulate(s *Stats) {
+	promTotals.Lock()
+	defer promTotals.Unlock()
+	if promTotals.m == nil {
+		promTotals.m = make(map[string]promTotal)
+	}
+	for n, t := range s.totals {
+		total := promTotals.m[n]
+		total.sum += t.sum
+		total.count += t.count
+		promTotals.m[n] = total
+	}
+}
+
+// addTimerTotals records the sum and count of the values received for a
+// timer, histogram or distribution series in the flush.
+func addTimerTotals(result *Stats, bucket string, tinfo timerInfo) {
+	sum := 0.0
+	for _, v := range tinfo.values {
+		sum += v
+	}
+	result.addTotal(bucket, promTotal{sum: sum, count: float64(tinfo.count)})
+}
+
+type promFamily struct {
+	name    string
+	typ     string
+	samples map[string]float64 // by name and labels
+}
+
+// promExposition collects the families of metrics, by name.
+type promExposition struct {
+	families map[string]*promFamily
+	owners   map[string]string // the family of each sample name
+}
+
+// add adds a sample named like the family to it. The values of counters that
+// map to the same sample are added up.
+func (e *promExposition) add(family, typ, labels string, v float64) {
+	e.addSample(family, family, typ, labels, v, typ == "counter")
+}
+
+// addSample adds a sample to the family, like the "_sum" and "_count"
+// samples of summaries. The sample is skipped if a family of another type has
+// the same name, or another family has samples with the same name. If the
+// family already has the sample, the values are added up if sum is set, and
+// the first one is kept otherwise.
+func (e *promExposition) addSample(family, name, typ, labels string, v float64, sum bool) {
+	if owner, ok := e.owners[name]; ok && owner != family {
+		return
+	}
+	f, ok := e.families[family]
+	if !ok {
+		f = &promFamily{name: family, typ: typ, samples: make(map[string]float64)}
+		e.families[family] = f
+	} else if f.typ != typ {
+		return
+	}
+	e.owners[name] = family
+	if old, ok := f.samples[name+labels]; !ok {
+		f.samples[name+labels] = v
+	} else if sum {
+		f.samples[name+labels] = old + v
+	}
+}
+
+func handlePrometheus(w http.ResponseWriter, r *http.Request) {
+	latest := data.Latest()
+	if latest == nil {
+		latest = &Stats{}
+	}
+	promTotals.Lock()
+	totals := make(map[string]promTotal, len(promTotals.m))
+	for n, t := range promTotals.m {
+		if _, _, ok := names.Type(n); ok {
+			totals[n] = t
+		} else {
+			delete(promTotals.m, n)
+		}
+	}
+	promTotals.Unlock()
+
+	e := promExposition{families: make(map[string]*promFamily), owners: make(map[string]string)}
+	for t, keys := range names.List() {
+		// in order, so that the same series win collisions every time
+		sort.Strings(keys)
+		for _, key := range keys {
+			name, labels, ok := promSeries(key)
+			if !ok {
+				continue
+			}
+			switch t {
+			case mtCounter:
+				if t, ok := totals[key]; ok {
+					e.add(name+"_total", "counter", promLabels(labels), t.sum)
+				}
+			case mtGauge, mtSet:
+				if v, ok := latest.Metrics[key]; ok && !math.IsNaN(v) {
+					e.add(name, "gauge", promLabels(labels), v)
+				}
+			case mtTimer, mtHistogram, mtDistribution:
+				addSummary(&e, key, name, labels, latest, totals)
+			}
+		}
+	}
+
+	all := make([]*promFamily, 0, len(e.families))
+	for _, f := range e.families {
+		all = append(all, f)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+	var buf bytes.Buffer
+	for _, f := range all {
+		samples := make([]string, 0, len(f.samples))
+		for s := range f.samples {
+			samples = append(samples, s)
+		}
+		sort.Strings(samples)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range samples {
+			fmt.Fprintf(&buf, "%s %s\n", s, promFloat(f.samples[s]))
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// addSummary adds a timer, histogram or distribution series as a summary,
+// with the upper percentiles and the median of the latest flush as quantiles.
+func addSummary(e *promExposition, key, name string, labels [][2]string, latest *Stats, totals map[string]promTotal) {
+	quantile := func(q string, v float64) {
+		ql := append(append([][2]string{}, labels...), [2]string{"quantile", q})
+		e.add(name, "summary", promLabels(ql), v)
+	}
+	median := true
+	for _, pct := range config.percentiles {
+		if pct <= 0 {
+			continue
+		}
+		if v, ok := latest.Metrics[seriesGen(key, ".upper_"+strconv.Itoa(pct))]; ok {
+			quantile(strconv.FormatFloat(float64(pct)/100, 'f', -1, 64), v)
+		}
+		if pct == 50 {
+			median = false
+		}
+	}
+	if v, ok := latest.Metrics[seriesGen(key, ".median")]; ok && median {
+		quantile("0.5", v)
+	}
+	if t, ok := totals[key]; ok {
+		e.addSample(name, name+"_sum", "summary", promLabels(labels), t.sum, true)
+		e.addSample(name, name+"_count", "summary", promLabels(labels), t.count, true)
+	}
+}
+
+// promSeries returns the Prometheus name and labels of the series key, as
+// per the mapping rules, or ok=false if it is dropped by them. The labels of
+// a mapping override the tags of the series.
+func promSeries(key string) (name string, labels [][2]string, ok bool) {
+	n, _ := splitSeries(key)
+	n, mlabels, drop := mapName(n)
+	if drop {
+		return "", nil, false
+	}
+	for k, v := range seriesTags(key) {
+		if _, ok := mlabels[k]; !ok {
+			labels = append(labels, [2]string{promLabelName(k), v})
+		}
+	}
+	for k, v := range mlabels {
+		labels = append(labels, [2]string{promLabelName(k), v})
+	}
+	return promName(n), labels, true
+}
+
+// promName sanitizes a name into a valid Prometheus metric name, replacing
+// the invalid characters with underscores.
+func promName(n string) string {
+	b := []byte(n)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '_' || c == ':') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// promLabelName sanitizes a tag name into a valid Prometheus label name.
+func promLabelName(n string) string {
+	return strings.Replace(promName(n), ":", "_", -1)
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabels formats the labels, sorted by name.
+func promLabels(labels [][2]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = l[0] + `="` + promEscaper.Replace(l[1]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func promFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
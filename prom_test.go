@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrometheusCollisions(t *testing.T) {
+	withDataDir(t, "")
+	savedTotals := promTotals.m
+	t.Cleanup(func() { promTotals.m = savedTotals })
+	promTotals.m = nil
+
+	names.Set("a.b", mtCounter)
+	names.Set("a_b", mtCounter)
+	names.Set("x", mtTimer)
+	names.Set("x_count", mtGauge)
+	names.Set("y", mtGauge)
+	names.Set("y.sum", mtGauge)
+	s := &Stats{At: time.Now(), Metrics: map[string]float64{
+		"a.b": 3, "a_b": 4, "x_count": 7, "y": 1, "y.sum": 2,
+	}}
+	s.addTotal("a.b", promTotal{sum: 3})
+	s.addTotal("a_b", promTotal{sum: 4})
+	s.addTotal("x", promTotal{sum: 30, count: 2})
+	data.Add(s)
+	promAccumulate(s)
+
+	w := httptest.NewRecorder()
+	handlePrometheus(w, httptest.NewRequest("GET", "/metrics", nil))
+	want := `# TYPE a_b_total counter
+a_b_total 7
+# TYPE x summary
+x_count 2
+x_sum 30
+# TYPE y gauge
+y 1
+# TYPE y_sum gauge
+y_sum 2
+`
+	if got := w.Body.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
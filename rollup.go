@@ -0,0 +1,176 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Besides the flushed values, which are kept for the retention period, the
+// values of each series can be rolled up into coarser resolutions that are
+// kept for longer. Rollups are set like "1m:1d,10m:30d", that is, 1 minute
+// values for 1 day and 10 minute values for 30 days. The values in each
+// interval are consolidated as per the type of the series: summed for
+// counters, counts and sums, the last one for gauges, the largest for sets
+// and upper timer stats, the smallest for lower timer stats, and the average
+// for the rest.
+
+type rollupConfig struct {
+	res       time.Duration
+	retention time.Duration
+}
+
+// parseDuration is time.ParseDuration that also takes days, like "30d".
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// rollups parses the rollups setting. The resolutions must be coarser than
+// the flush interval and the resolution before them.
+func rollups(s string) (r []rollupConfig) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return
+	}
+	prev := config.flush
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 2 {
+			log.Fatalf("invalid rollup %q, must be resolution:retention", entry)
+		}
+		res, err := parseDuration(parts[0])
+		if err != nil {
+			log.Fatalf("invalid rollup resolution %q: %v", parts[0], err)
+		}
+		retention, err := parseDuration(parts[1])
+		if err != nil {
+			log.Fatalf("invalid rollup retention %q: %v", parts[1], err)
+		}
+		if res <= prev {
+			log.Fatalf("invalid rollup %q, resolution must be coarser than %v", entry, prev)
+		}
+		if retention < res {
+			log.Fatalf("invalid rollup %q, retention must not be less than resolution", entry)
+		}
+		r = append(r, rollupConfig{res: res, retention: retention})
+		prev = res
+	}
+	return
+}
+
+const (
+	consolAvg = iota
+	consolSum
+	consolMin
+	consolMax
+	consolLast
+)
+
+// consolidation returns how the values of the named series are consolidated.
+func consolidation(n string) int {
+	t, base, ok := names.Type(n)
+	if !ok {
+		return consolAvg
+	}
+	switch t {
+	case mtCounter:
+		return consolSum
+	case mtGauge:
+		return consolLast
+	case mtSet:
+		return consolMax
+	case mtGen:
+		name, _ := splitSeries(n)
+		bname, _ := splitSeries(base)
+		suffix := strings.TrimPrefix(name, bname)
+		switch {
+		case strings.HasPrefix(suffix, ".upper"):
+			return consolMax
+		case strings.HasPrefix(suffix, ".lower"):
+			return consolMin
+		case suffix == ".count_ps":
+			return consolAvg
+		case strings.HasPrefix(suffix, ".count"), strings.HasPrefix(suffix, ".sum"),
+			strings.HasPrefix(suffix, ".histogram."):
+			return consolSum
+		}
+	}
+	return consolAvg
+}
+
+// rollup is the values of a series in the current interval of a tier.
+type rollup struct {
+	consol int
+	count  int
+	sum    float64
+	min    float64
+	max    float64
+	last   float64
+}
+
+func (ru *rollup) add(v float64) {
+	if ru.count == 0 || v < ru.min {
+		ru.min = v
+	}
+	if ru.count == 0 || v > ru.max {
+		ru.max = v
+	}
+	ru.sum += v
+	ru.last = v
+	ru.count++
+}
+
+func (ru *rollup) value() float64 {
+	switch ru.consol {
+	case consolSum:
+		return ru.sum
+	case consolMin:
+		return ru.min
+	case consolMax:
+		return ru.max
+	case consolLast:
+		return ru.last
+	}
+	return ru.sum / float64(ru.count)
+}
+
+// rollup adds the values flushed at t to the current interval of the tier,
+// first storing the values of the earlier interval if t is past it.
+func (tr *tier) rollup(metrics map[string]float64, t int64) {
+	res := int64(tr.res / time.Millisecond)
+	b := t - t%res
+	if b < tr.bucket {
+		return
+	}
+	if b > tr.bucket {
+		tr.closeBucket()
+		tr.bucket = b
+	}
+	for n, v := range metrics {
+		if math.IsNaN(v) {
+			continue
+		}
+		ru, ok := tr.pending[n]
+		if !ok {
+			ru = &rollup{consol: consolidation(n)}
+			tr.pending[n] = ru
+		}
+		ru.add(v)
+	}
+}
+
+// closeBucket stores the consolidated values of the current interval.
+func (tr *tier) closeBucket() {
+	for n, ru := range tr.pending {
+		tr.append(n, tr.bucket, ru.value())
+	}
+	tr.pending = make(map[string]*rollup)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Aggregation is split into shards, each with its own queue, holding area and
+// aggregator goroutine. A series always goes to the same shard, selected by
+// the hash of its key, so each shard flushes exactly what a single holding
+// area would have for its series. The flusher merges the results of all the
+// shards into one Stats.
+
+type shard struct {
+	index   int
+	queue   chan sdop
+	flush   chan flushRequest
+	stop    chan struct{} // closed to stop the aggregator
+	area    HoldingArea
+	evicted int32 // set atomically when series of the shard have been evicted
+}
+
+type flushRequest struct {
+	now    time.Time
+	result chan *Stats
+}
+
+func newShard(index int) *shard {
+	return &shard{
+		index: index,
+		queue: make(chan sdop, config.queueLen),
+		flush: make(chan flushRequest),
+		stop:  make(chan struct{}),
+	}
+}
+
+// The aggregator thread of a shard.
+func (sh *shard) aggregator() {
+	// setup
+	sh.area.clear()
+
+	for {
+		select {
+		case op := <-sh.queue:
+			if atomic.LoadInt32(&sh.evicted) != 0 {
+				sh.dropEvicted()
+			}
+			sh.area.apply(&op)
+		case req := <-sh.flush:
+			result := &Stats{
+				At:      req.now,
+				Metrics: make(map[string]float64),
+			}
+			if atomic.LoadInt32(&sh.evicted) != 0 {
+				sh.dropEvicted()
+			}
+			if sh == shards[0] {
+				recordInternal(&sh.area, req.now)
+			}
+			sh.area.flush(result, req.now)
+			req.result <- result
+		case <-sh.stop:
+			return
+		}
+	}
+}
+
+// shard returns the index of the shard the operation goes to.
+func (op *sdop) shard() int {
+	return seriesShard(op.name, op.tags)
+}
+
+// seriesShard returns the index of the shard for the series with the name and
+// tags, from the FNV-1a hash of its key, without making the key.
+func seriesShard(name, tags string) int {
+	if len(shards) == 1 {
+		return 0
+	}
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h = (h ^ uint32(name[i])) * 16777619
+	}
+	for i := 0; i < len(tags); i++ {
+		h = (h ^ uint32(tags[i])) * 16777619
+	}
+	return int(h % uint32(len(shards)))
+}
+
+// The flusher thread.
+func flusher() {
+	timer := time.NewTicker(config.flush)
+	for range timer.C {
+		statsdFlush()
+	}
+}
+
+// statsdFlush flushes all the shards in parallel, and stores the merged
+// result.
+func statsdFlush() {
+	now := time.Now()
+	ch := make(chan *Stats, len(shards))
+	for _, sh := range shards {
+		sh.flush <- flushRequest{now: now, result: ch}
+	}
+	result := <-ch
+	for i := 1; i < len(shards); i++ {
+		part := <-ch
+		for k, v := range part.Metrics {
+			result.Metrics[k] = v
+		}
+		for k, v := range part.totals {
+			result.addTotal(k, v)
+		}
+	}
+	if len(config.dataDir) > 0 {
+		appendWAL(result)
+	}
+	data.Add(result)
+	promAccumulate(result)
+	if len(carbonServers) > 0 {
+		forwardCarbon(result)
+	}
+	enforceMemory()
+	flushed(len(result.Metrics), time.Since(now))
+}
+
+// queueDepth returns the number of values waiting in the queues of all the
+// shards, and their total capacity.
+func queueDepth() (depth, capacity int) {
+	for _, sh := range shards {
+		depth += len(sh.queue)
+		capacity += cap(sh.queue)
+	}
+	return
+}
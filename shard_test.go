@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkShards measures the aggregation of counters, timers and gauges
+// over 1000 names, from queueOp to the flush of the shards, without the
+// sockets and the parser.
+func BenchmarkShards(b *testing.B) {
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("bench.metric%d", i)
+	}
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			saved := shards
+			shards = make([]*shard, n)
+			for i := range shards {
+				shards[i] = newShard(i)
+				go shards[i].aggregator()
+			}
+			defer func() {
+				for _, sh := range shards {
+					close(sh.stop)
+				}
+				shards = saved
+			}()
+			var seq uint32
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddUint32(&seq, 1)) * 7919
+				for pb.Next() {
+					op := sdop{name: names[i%len(names)], rate: math.NaN()}
+					switch i % 3 {
+					case 0:
+						op.op, op.ival = SDOP_C_ADD, 1
+					case 1:
+						op.op, op.fval = SDOP_T, float64(i%100)
+					case 2:
+						op.op, op.ival = SDOP_G_SET, int64(i%100)
+					}
+					queueOp(op)
+					i++
+				}
+			})
+			// the aggregators apply the values left in the queues before
+			// taking the flush requests
+			for _, sh := range shards {
+				for len(sh.queue) > 0 {
+					runtime.Gosched()
+				}
+			}
+			ch := make(chan *Stats, len(shards))
+			for _, sh := range shards {
+				sh.flush <- flushRequest{now: time.Now(), result: ch}
+			}
+			for range shards {
+				<-ch
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+// soReusePort is SO_REUSEPORT, which package syscall does not define for all
+// architectures.
+const soReusePort = 0xf
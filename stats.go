@@ -13,28 +13,195 @@ import (
 type Stats struct {
 	At      time.Time
 	Metrics map[string]float64
+	totals  map[string]promTotal // values received, for the Prometheus totals
 }
 
 func (s *Stats) add(k string, v float64) {
 	s.Metrics[k] = v
 }
 
-// StatsRing is a ring buffer of Stats objects. Kind of.
-type StatsRing struct {
+// addTotal records the values of a series received in the flush, as opposed
+// to sent again by an idle policy.
+func (s *Stats) addTotal(k string, t promTotal) {
+	if s.totals == nil {
+		s.totals = make(map[string]promTotal)
+	}
+	s.totals[k] = t
+}
+
+// SeriesStore keeps the flushed values of each series, compressed, for the
+// retention period, and their rollups into coarser resolutions for longer.
+type SeriesStore struct {
 	sync.Mutex
-	Values []*Stats
-	Head   int
+	tiers  []*tier   // the flushed values first, then the rollups
+	last   time.Time // time of the latest flush
+	latest *Stats    // the latest flush
+}
+
+// tier is the values of the series at one resolution.
+type tier struct {
+	res       time.Duration
+	retention time.Duration
+	series    map[string]*series
+	bucket    int64              // start of the current interval of a rollup
+	pending   map[string]*rollup // values in the current interval of a rollup
+}
+
+// series is the compressed points of a series, in chunks, oldest first.
+type series struct {
+	chunks []*chunk
+}
+
+func NewSeriesStore() *SeriesStore {
+	r := &SeriesStore{}
+	r.tiers = append(r.tiers, newTier(config.flush, config.retention))
+	for _, ru := range config.rollups {
+		r.tiers = append(r.tiers, newTier(ru.res, ru.retention))
+	}
+	return r
+}
+
+func newTier(res, retention time.Duration) *tier {
+	return &tier{
+		res:       res,
+		retention: retention,
+		series:    make(map[string]*series),
+		pending:   make(map[string]*rollup),
+	}
+}
+
+// Add stores the values of a flush, and drops the values older than the
+// retention period of each tier.
+func (r *SeriesStore) Add(s *Stats) {
+	r.Lock()
+	defer r.Unlock()
+	t := s.At.UnixNano() / 1e6
+	for n, v := range s.Metrics {
+		r.tiers[0].append(n, t, v)
+	}
+	for _, tr := range r.tiers[1:] {
+		tr.rollup(s.Metrics, t)
+	}
+	if s.At.After(r.last) {
+		r.last = s.At
+		r.latest = s
+	}
+	for _, tr := range r.tiers {
+		tr.expire(s.At.Add(-tr.retention))
+	}
+}
+
+func (tr *tier) append(n string, t int64, v float64) {
+	sr, ok := tr.series[n]
+	if !ok {
+		sr = &series{}
+		tr.series[n] = sr
+	}
+	var c *chunk
+	if n := len(sr.chunks); n > 0 {
+		c = sr.chunks[n-1]
+		if t <= c.last {
+			return // out of order
+		}
+	}
+	if c == nil || c.full() {
+		c = &chunk{}
+		sr.chunks = append(sr.chunks, c)
+	}
+	c.append(t, v)
 }
 
-func NewStatsRing(n int) *StatsRing {
-	return &StatsRing{Values: make([]*Stats, n)}
+// expire drops the chunks with only points older than oldest, and the series
+// left without any chunks.
+func (tr *tier) expire(oldest time.Time) {
+	t := oldest.UnixNano() / 1e6
+	for n, sr := range tr.series {
+		i := 0
+		for i < len(sr.chunks) && sr.chunks[i].last < t {
+			i++
+		}
+		if i == len(sr.chunks) {
+			delete(tr.series, n)
+		} else if i > 0 {
+			sr.chunks = append(sr.chunks[:0], sr.chunks[i:]...)
+		}
+	}
+}
+
+// Remove drops all the values of the given series.
+func (r *SeriesStore) Remove(ns []string) {
+	r.Lock()
+	for _, tr := range r.tiers {
+		for _, n := range ns {
+			delete(tr.series, n)
+			delete(tr.pending, n)
+		}
+	}
+	r.Unlock()
+}
+
+// Latest returns the latest flush, or nil if there has not been any.
+func (r *SeriesStore) Latest() *Stats {
+	r.Lock()
+	defer r.Unlock()
+	return r.latest
+}
+
+// Last returns the time of the latest flush.
+func (r *SeriesStore) Last() time.Time {
+	r.Lock()
+	defer r.Unlock()
+	return r.last
+}
+
+// pickTier returns the finest tier that has values for the span of time up to
+// the latest flush, or the one with the longest retention if none does.
+func (r *SeriesStore) pickTier(span time.Duration) *tier {
+	best := r.tiers[0]
+	for _, tr := range r.tiers {
+		if tr.retention >= span {
+			return tr
+		}
+		if tr.retention > best.retention {
+			best = tr
+		}
+	}
+	return best
+}
+
+// points returns the points of the series from oldest to latest.
+func (sr *series) points(oldest, latest int64) (ts []int64, vs []float64) {
+	for _, c := range sr.chunks {
+		if c.last < oldest || c.first > latest {
+			continue
+		}
+		it := c.iter()
+		for t, v, ok := it.next(); ok; t, v, ok = it.next() {
+			if t >= oldest && t <= latest {
+				ts = append(ts, t)
+				vs = append(vs, v)
+			}
+		}
+	}
+	return
 }
 
-func (r *StatsRing) Add(s *Stats) {
+// Query returns the points of each of the series from from to to, in Unix
+// milliseconds, from the finest tier that has values from from on, and the
+// resolution of the tier.
+func (r *SeriesStore) Query(names []string, from, to time.Time) (res time.Duration, ts [][]int64, vs [][]float64) {
 	r.Lock()
 	defer r.Unlock()
-	r.Values[r.Head] = s
-	r.Head = (r.Head + 1) % len(r.Values)
+	tr := r.pickTier(r.last.Sub(from))
+	oldest, latest := from.UnixNano()/1e6, to.UnixNano()/1e6
+	ts = make([][]int64, len(names))
+	vs = make([][]float64, len(names))
+	for i, n := range names {
+		if sr, ok := tr.series[n]; ok {
+			ts[i], vs[i] = sr.points(oldest, latest)
+		}
+	}
+	return tr.res, ts, vs
 }
 
 type GraphData struct {
@@ -42,6 +209,9 @@ type GraphData struct {
 	Title      string
 	Metrics    []string
 	Datapoints []Datapoint
+	Heatmap    bool
+	Bins       []string
+	Resolution time.Duration
 }
 
 type Datapoint struct {
@@ -61,37 +231,97 @@ func (d *Datapoint) ValuesStr() template.JS {
 	return template.JS(strings.Join(parts, ", "))
 }
 
-func (r *StatsRing) GetDataForGraph(names []string) (g GraphData) {
-	r.Lock()
-	defer r.Unlock()
+// GetDataForGraph returns the values of the series for the span of time up
+// to now, from the finest tier that has them. If span is 0, it is the
+// retention period.
+func (r *SeriesStore) GetDataForGraph(names []string, span time.Duration) (g GraphData) {
 	g.Metrics = names
-	g.Datapoints = make([]Datapoint, 0, len(r.Values))
-	pos := r.Head
-	for {
-		pos = (pos + 1) % len(r.Values)
-		if pos == r.Head {
-			return
-		}
-		if r.Values[pos] != nil {
-			m := r.Values[pos].Metrics
-			dp := Datapoint{
-				At:     r.Values[pos].At,
-				Values: make([]float64, len(names)),
+	if span <= 0 {
+		span = config.retention
+	}
+	now := time.Now()
+	var ts [][]int64
+	var vs [][]float64
+	g.Resolution, ts, vs = r.Query(names, now.Add(-span), now)
+	// the times of all the points
+	times := make(map[int64]bool)
+	for i := range names {
+		for _, t := range ts[i] {
+			times[t] = true
+		}
+	}
+	all := make([]int64, 0, len(times))
+	for t := range times {
+		all = append(all, t)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+
+	g.Datapoints = make([]Datapoint, len(all))
+	pos := make([]int, len(names))
+	for j, t := range all {
+		dp := Datapoint{
+			At:     time.Unix(0, t*1e6),
+			Values: make([]float64, len(names)),
+		}
+		for i := range names {
+			if pos[i] < len(ts[i]) && ts[i][pos[i]] == t {
+				dp.Values[i] = vs[i][pos[i]]
+				pos[i]++
+			} else {
+				dp.Values[i] = math.NaN()
 			}
-			allNaN := true
-			for i, n := range names {
-				if v, found := m[n]; found {
-					dp.Values[i] = v
-					allNaN = false
-				} else {
-					dp.Values[i] = math.NaN()
-				}
+		}
+		g.Datapoints[j] = dp
+	}
+	return
+}
+
+// seriesMemory is the memory used by the values of a series.
+type seriesMemory struct {
+	Name   string
+	Points int
+	Chunks int
+	Bytes  int
+}
+
+// BytesPerPoint returns the average number of bytes used per point.
+func (m seriesMemory) BytesPerPoint() string {
+	if m.Points == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(float64(m.Bytes)/float64(m.Points), 'f', 2, 64)
+}
+
+// Memory returns the memory used by each series in all the tiers, largest
+// first.
+func (r *SeriesStore) Memory() (out []seriesMemory) {
+	r.Lock()
+	index := make(map[string]int)
+	for _, tr := range r.tiers {
+		for n, sr := range tr.series {
+			i, ok := index[n]
+			if !ok {
+				i = len(out)
+				index[n] = i
+				out = append(out, seriesMemory{Name: n})
 			}
-			if !allNaN {
-				g.Datapoints = append(g.Datapoints, dp)
+			m := &out[i]
+			m.Chunks += len(sr.chunks)
+			m.Bytes += len(n) + 48
+			for _, c := range sr.chunks {
+				m.Points += c.n
+				m.Bytes += c.size()
 			}
 		}
 	}
+	r.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Bytes != out[j].Bytes {
+			return out[i].Bytes > out[j].Bytes
+		}
+		return out[i].Name < out[j].Name
+	})
+	return
 }
 
 const (
@@ -99,23 +329,31 @@ const (
 	mtTimer
 	mtGauge
 	mtSet
-	mtTimerGen
+	mtGen
+	mtHistogram
+	mtDistribution
 )
 
 type MetricNames struct {
 	Names map[string]int
+	Gens  map[string]map[string]bool // generated names of each series
+	bases map[string]string          // series of each generated name
 	sync.Mutex
 }
 
 func NewMetricNames() *MetricNames {
-	return &MetricNames{Names: make(map[string]int)}
+	return &MetricNames{
+		Names: make(map[string]int),
+		Gens:  make(map[string]map[string]bool),
+		bases: make(map[string]string),
+	}
 }
 
 func (m *MetricNames) List() (out [][]string) {
 	m.Lock()
-	out = make([][]string, 4)
+	out = make([][]string, mtDistribution+1)
 	for n, t := range m.Names {
-		if t != mtTimerGen {
+		if t != mtGen {
 			out[t] = append(out[t], n)
 		}
 	}
@@ -137,19 +375,82 @@ func (m *MetricNames) Add(a *HoldingArea) {
 	for n, _ := range a.sets {
 		m.Names[n] = mtSet
 	}
+	for n, _ := range a.histograms {
+		m.Names[n] = mtHistogram
+	}
+	for n, _ := range a.distributions {
+		m.Names[n] = mtDistribution
+	}
+	m.Unlock()
+}
+
+func (m *MetricNames) AddGen(base, n string) {
+	m.Lock()
+	m.Names[n] = mtGen
+	if g, ok := m.Gens[base]; ok {
+		g[n] = true
+	} else {
+		m.Gens[base] = map[string]bool{n: true}
+	}
+	m.bases[n] = base
+	m.Unlock()
+}
+
+// Set adds the name with its type, which is not one of the generated names.
+func (m *MetricNames) Set(n string, t int) {
+	m.Lock()
+	m.Names[n] = t
+	m.Unlock()
+}
+
+// Type returns the type of the name, and for generated names, the series it
+// was generated from.
+func (m *MetricNames) Type(n string) (t int, base string, ok bool) {
+	m.Lock()
+	t, ok = m.Names[n]
+	if ok && t == mtGen {
+		base = m.bases[n]
+	}
 	m.Unlock()
+	return
 }
 
-func (m *MetricNames) AddTimerGen(n string) {
+// Remove forgets the given series names, along with the names generated from
+// them.
+func (m *MetricNames) Remove(ns []string) {
+	if len(ns) == 0 {
+		return
+	}
 	m.Lock()
-	m.Names[n] = mtTimerGen
+	for _, n := range ns {
+		delete(m.Names, n)
+		for g, _ := range m.Gens[n] {
+			delete(m.Names, g)
+			delete(m.bases, g)
+		}
+		delete(m.Gens, n)
+	}
 	m.Unlock()
 }
 
+// WithGens returns the given series names, followed by the names generated
+// from them.
+func (m *MetricNames) WithGens(ns []string) (out []string) {
+	out = append(out, ns...)
+	m.Lock()
+	for _, n := range ns {
+		for g, _ := range m.Gens[n] {
+			out = append(out, g)
+		}
+	}
+	m.Unlock()
+	return
+}
+
 func (m *MetricNames) Find(r string) (out []string) {
 	m.Lock()
 	for n, _ := range m.Names {
-		if strings.HasPrefix(n, r) {
+		if matchSeries(r, n) {
 			out = append(out, n)
 		}
 	}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// withRollups sets up the configuration of the series store for a test.
+func withRollups(t *testing.T, flush, retention time.Duration, ru string) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.flush = flush
+	config.retention = retention
+	config.rollups = rollups(ru)
+}
+
+func TestQueryTier(t *testing.T) {
+	withRollups(t, 10*time.Second, 30*time.Minute, "1m:1d")
+	r := NewSeriesStore()
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		r.Add(&Stats{At: now.Add(time.Duration(i-9) * 10 * time.Second), Metrics: map[string]float64{"a": 1}})
+	}
+	for _, c := range []struct {
+		span time.Duration
+		res  time.Duration
+	}{
+		{10 * time.Minute, 10 * time.Second},
+		{30 * time.Minute, 10 * time.Second},
+		{2 * time.Hour, time.Minute},
+	} {
+		if res, _, _ := r.Query([]string{"a"}, time.Now().Add(-c.span), time.Now()); res != c.res {
+			t.Errorf("span %v: resolution %v, want %v", c.span, res, c.res)
+		}
+	}
+	if g := r.GetDataForGraph([]string{"a"}, 0); g.Resolution != 10*time.Second {
+		t.Errorf("default span: resolution %v, want 10s", g.Resolution)
+	}
+}
@@ -3,31 +3,60 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"fmt"
+	"errors"
 	"io"
 	"log"
 	"math"
 	"net"
+	"os"
 	"sort"
 	"strconv"
-	"strings"
+	"sync/atomic"
 	"time"
-)
 
-const queueLen = 1000
+	"github.com/rapidloop/statsd-vis/statsdline"
+)
 
 type HoldingArea struct {
-	counters map[string]int64
-	timers   map[string]timerInfo
-	gauges   map[string]int64
-	sets     map[string]map[string]bool
+	counters      map[string]int64
+	timers        map[string]timerInfo
+	gauges        map[string]int64
+	gaugesAt      map[string]time.Time
+	sets          map[string]map[string]bool
+	histograms    map[string]timerInfo
+	distributions map[string]timerInfo
+	seen          map[string]*seriesInfo
+	lastFlush     time.Time
 }
 
 func (h *HoldingArea) clear() {
 	h.counters = make(map[string]int64)
 	h.timers = make(map[string]timerInfo)
 	h.sets = make(map[string]map[string]bool)
-	h.gauges = make(map[string]int64)
+	h.histograms = make(map[string]timerInfo)
+	h.distributions = make(map[string]timerInfo)
+	// gauges keep their last value across flushes, until they expire
+	if h.gauges == nil {
+		h.gauges = make(map[string]int64)
+		h.gaugesAt = make(map[string]time.Time)
+		h.seen = make(map[string]*seriesInfo)
+	}
+}
+
+// expireGauges removes the gauges that have not been updated for longer than
+// the gauge expiry interval or the idle TTL, and returns their names. Gauges
+// never expire if both are 0.
+func (h *HoldingArea) expireGauges(now time.Time) (expired []string) {
+	for n, at := range h.gaugesAt {
+		idle := now.Sub(at)
+		if (config.gaugeExpiry > 0 && idle > config.gaugeExpiry) ||
+			(config.idleTTL > 0 && idle > config.idleTTL) {
+			delete(h.gauges, n)
+			delete(h.gaugesAt, n)
+			expired = append(expired, n)
+		}
+	}
+	return
 }
 
 type timerInfo struct {
@@ -35,11 +64,19 @@ type timerInfo struct {
 	count  int64
 }
 
+// udpSocket is a statsd UDP listening socket. There is more than one if
+// SO_REUSEPORT is used.
+type udpSocket struct {
+	conn      *net.UDPConn
+	overflows uint32 // datagrams dropped by the kernel, updated atomically
+}
+
 var (
-	udpConn *net.UDPConn
-	tcpLis  *net.TCPListener
-	queue   chan sdop
-	area    HoldingArea
+	udpSockets   []*udpSocket
+	tcpLis       *net.TCPListener
+	unixgramConn *net.UnixConn
+	unixLis      *net.UnixListener
+	shards       []*shard
 )
 
 func startStatsd() {
@@ -53,9 +90,16 @@ func startStatsd() {
 		log.Fatalf("statsd tcp listen address: %v", err)
 	}
 
-	udpConn, err = net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		log.Fatalf("statsd udp listen: %v", err)
+	nsock := 1
+	if config.udpReusePort {
+		nsock = config.udpReaders
+	}
+	for i := 0; i < nsock; i++ {
+		conn, err := listenUDP(udpAddr, config.udpReusePort)
+		if err != nil {
+			log.Fatalf("statsd udp listen: %v", err)
+		}
+		udpSockets = append(udpSockets, &udpSocket{conn: conn})
 	}
 
 	tcpLis, err = net.ListenTCP("tcp", tcpAddr)
@@ -63,16 +107,87 @@ func startStatsd() {
 		log.Fatalf("statsd tcp listen: %v", err)
 	}
 
-	queue = make(chan sdop, queueLen)
-	go aggregator()
-	go udpHandler()
+	if len(config.statsdUnixgram) > 0 {
+		removeSocket(config.statsdUnixgram)
+		addr := &net.UnixAddr{Name: config.statsdUnixgram, Net: "unixgram"}
+		if unixgramConn, err = net.ListenUnixgram("unixgram", addr); err != nil {
+			log.Fatalf("statsd unixgram listen: %v", err)
+		}
+	}
+
+	if len(config.statsdUnix) > 0 {
+		removeSocket(config.statsdUnix)
+		addr := &net.UnixAddr{Name: config.statsdUnix, Net: "unix"}
+		if unixLis, err = net.ListenUnix("unix", addr); err != nil {
+			log.Fatalf("statsd unix listen: %v", err)
+		}
+	}
+
+	for _, sock := range udpSockets {
+		if config.udpRcvbuf > 0 {
+			if err := sock.conn.SetReadBuffer(config.udpRcvbuf); err != nil {
+				log.Printf("statsd udp: cannot set receive buffer size: %v", err)
+			}
+		}
+		setupUDP(sock)
+	}
+	shards = make([]*shard, config.shards)
+	if limited() {
+		startLimits()
+	}
+	for i := range shards {
+		shards[i] = newShard(i)
+		go shards[i].aggregator()
+	}
+	go flusher()
+	for i := 0; i < config.udpReaders; i++ {
+		go udpHandler(udpSockets[i%len(udpSockets)])
+	}
 	go tcpHandler()
+	if unixgramConn != nil {
+		go unixgramHandler()
+	}
+	if unixLis != nil {
+		go unixHandler()
+	}
+}
+
+// stopStatsd closes the unix domain socket listeners and removes their socket
+// files.
+func stopStatsd() {
+	if unixgramConn != nil {
+		unixgramConn.Close()
+		os.Remove(config.statsdUnixgram)
+	}
+	if unixLis != nil {
+		unixLis.Close()
+		os.Remove(config.statsdUnix)
+	}
+}
+
+// removeSocket removes a unix domain socket file left behind by an earlier
+// run, so that we can listen on it again. Other kinds of files are not removed.
+func removeSocket(path string) {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Fatalf("statsd socket %s: %v", path, err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		log.Fatalf("statsd socket %s: file exists and is not a socket", path)
+	}
+	if err := os.Remove(path); err != nil {
+		log.Fatalf("statsd socket %s: %v", path, err)
+	}
 }
 
-func udpHandler() {
-	buf := make([]byte, 16384)
+func udpHandler(sock *udpSocket) {
+	var p lineParser
+	buf := make([]byte, config.maxDatagram)
+	oob := make([]byte, 64)
 	for {
-		n, addr, err := udpConn.ReadFromUDP(buf)
+		n, addr, err := readUDP(sock, buf, oob)
 		if err != nil {
 			if addr != nil {
 				log.Printf("statsd udp read error from %v: %v", addr, err)
@@ -83,17 +198,27 @@ func udpHandler() {
 		} else if n == 0 {
 			log.Printf("statsd udp read 0 bytes from %v", addr)
 		} else {
-			if bytes.IndexByte(buf[:n], '\n') == -1 {
-				// optimization: typical single-line packets
-				parseLineToQueue(string(buf[:n]), addr)
-			} else {
-				// costly, generic, multi-line scanner
-				parseToQueue(bytes.NewBuffer(buf[:n]), addr)
-			}
+			p.parsePacket(buf[:n], addr)
 			buf = buf[:len(buf)]
 		}
 	}
-	udpConn.Close()
+	sock.conn.Close()
+}
+
+func unixgramHandler() {
+	var p lineParser
+	buf := make([]byte, config.maxDatagram)
+	for {
+		n, addr, err := unixgramConn.ReadFromUnix(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("statsd unixgram read error: %v", err)
+			}
+			break
+		} else if n > 0 {
+			p.parsePacket(buf[:n], addr)
+		}
+	}
 }
 
 func tcpHandler() {
@@ -103,104 +228,176 @@ func tcpHandler() {
 			log.Printf("statsd tcp accept error: %v", err)
 			break
 		} else {
-			go tcpClientHandler(tcpConn)
+			go streamClientHandler(tcpConn, &tcpOpen)
 		}
 	}
 }
 
-func tcpClientHandler(tcpConn *net.TCPConn) {
-	rip := tcpConn.RemoteAddr()
-	parseToQueue(tcpConn, rip)
-	tcpConn.Close()
+func unixHandler() {
+	for {
+		unixConn, err := unixLis.AcceptUnix()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("statsd unix accept error: %v", err)
+			}
+			break
+		} else {
+			go streamClientHandler(unixConn, &unixOpen)
+		}
+	}
+}
+
+func streamClientHandler(conn net.Conn, open *int64) {
+	atomic.AddInt64(open, 1)
+	rip := conn.RemoteAddr()
+	parseToQueue(conn, rip)
+	conn.Close()
+	atomic.AddInt64(open, -1)
 }
 
 func parseToQueue(r io.Reader, rip net.Addr) {
+	var p lineParser
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		parseLineToQueue(scanner.Text(), rip)
+		p.parseLine(scanner.Bytes(), rip)
+	}
+}
+
+// lineParser parses the lines received by a listener and queues the ops. It
+// reuses its metrics buffer, and keeps the strings made for the names and
+// tags seen, so that lines with names and tags seen before do not allocate.
+type lineParser struct {
+	metrics []statsdline.Metric
+	names   map[string]string
+	tags    map[string]string
+	mapped  map[string]*mappedName
+	buf     []byte
+}
+
+// maxInterned is the number of names, and of tags, that a line parser keeps.
+// Once there are more, it starts again with none.
+const maxInterned = 10000
+
+// reasons for rejecting a line, other than the parse errors
+const (
+	badReserved  = statsdline.NumErrors // name with the internal metrics prefix
+	badLineKinds = badReserved + 1
+)
+
+func badLineName(bad int) string {
+	if bad == badReserved {
+		return "reserved"
 	}
+	return statsdline.Error(bad).Name()
 }
 
-// gorets:1|c
-// gorets:1|c|@0.1
-// glork:320|ms
-// glork:320|ms|@0.1
-// gaugor:333|g
-// gaugor:-10|g
-// uniques:765|s
+var internalPrefixBytes = []byte(internalPrefix)
+
+func (p *lineParser) parsePacket(buf []byte, addr net.Addr) {
+	countPacket()
+	for len(buf) > 0 {
+		var line []byte
+		line, buf = statsdline.NextLine(buf)
+		p.parseLine(line, addr)
+	}
+}
 
-func parseLineToQueue(line string, rip net.Addr) {
+func (p *lineParser) parseLine(line []byte, rip net.Addr) {
+	if bytes.HasPrefix(line, internalPrefixBytes) {
+		rejectLine(line, rip, badReserved)
+		return
+	}
 	var err error
-	colon := strings.Index(line, ":")
-	bar1 := strings.Index(line, "|")
-	if colon < 1 || bar1 < colon || bar1 == colon+1 || bar1 == len(line)-1 {
-		log.Printf("bad line [%s] from ip [%v]", line, rip)
+	if p.metrics, err = statsdline.Parse(line, p.metrics[:0]); err != nil {
+		rejectLine(line, rip, int(err.(statsdline.Error)))
 		return
 	}
-	typeEnd := len(line)
-	bar2 := strings.Index(line[bar1+1:], "|")
-	sampleRate := math.NaN()
-	if bar2 != -1 {
-		typeEnd = bar1 + 1 + bar2
-		rest := line[bar1+1+bar2+1:]
-		if len(rest) < 2 || rest[0] != '@' {
-			log.Printf("bad line [%s] from ip [%v]", line, rip)
-			return
+	countLine()
+
+	for i := range p.metrics {
+		m := &p.metrics[i]
+		op := sdop{name: intern(&p.names, m.Name, false), rate: m.Rate}
+		if len(m.Tags) > 0 {
+			op.tags = intern(&p.tags, m.Tags, true)
 		}
-		if sampleRate, err = strconv.ParseFloat(rest[1:], 64); err != nil {
-			log.Printf("bad line [%s] from ip [%v]", line, rip)
-			return
+		if config.mapIngest {
+			mn := p.mapIngest(m.Name)
+			if mn.drop {
+				countMappingDrop()
+				continue
+			}
+			op.name = mn.name
+			if len(mn.tags) > 0 {
+				p.buf = mn.appendTags(p.buf[:0], m.Tags)
+				op.tags = intern(&p.tags, p.buf, true)
+			}
 		}
+		switch m.Type {
+		case statsdline.Counter:
+			op.op = SDOP_C_ADD
+			op.ival = m.Int
+		case statsdline.Timer:
+			op.op = SDOP_T
+			op.fval = m.Float
+		case statsdline.Histogram:
+			op.op = SDOP_H
+			op.fval = m.Float
+		case statsdline.Distribution:
+			op.op = SDOP_D
+			op.fval = m.Float
+		case statsdline.Gauge:
+			if !m.Delta() {
+				op.op = SDOP_G_SET
+				op.ival = m.Int
+			} else if m.Int >= 0 {
+				op.op = SDOP_G_INCR
+				op.ival = m.Int
+			} else {
+				op.op = SDOP_G_DECR
+				op.ival = -m.Int
+			}
+		case statsdline.Set:
+			op.op = SDOP_S
+			op.sval = string(m.Value)
+		}
+		queueOp(op)
 	}
+}
 
-	// op is the operation that we're parsing into
-	op := sdop{name: line[0:colon], rate: sampleRate}
+// intern returns the string for b from the map, adding it if it is not there.
+// If tags is set, b is a DogStatsD tag list and the string is the series key
+// suffix for it.
+func intern(m *map[string]string, b []byte, tags bool) string {
+	if s, ok := (*m)[string(b)]; ok {
+		return s
+	}
+	if *m == nil || len(*m) >= maxInterned {
+		*m = make(map[string]string)
+	}
+	s := string(b)
+	if tags {
+		s, _ = parseTags(s)
+	}
+	(*m)[string(b)] = s
+	return s
+}
 
-	value := line[colon+1 : bar1]
-	switch line[bar1+1 : typeEnd] {
-	case "c":
-		ival, err := strconv.ParseInt(value, 10, 64)
-		if err != nil || ival < 0 {
-			log.Printf("bad line [%s] from ip [%v]", line, rip)
-			return
-		}
-		op.op = SDOP_C_ADD
-		op.ival = ival
-		//log.Printf("counter: %s=%d @ %.2f", line[0:colon], ival, sampleRate)
-	case "ms":
-		fval, err := strconv.ParseFloat(value, 64)
-		if err != nil {
-			log.Printf("bad line [%s] from ip [%v]", line, rip)
-			return
-		}
-		op.op = SDOP_T
-		op.fval = fval
-		//log.Printf("timer: %s=%.2f @ %.2f", line[0:colon], fval, sampleRate)
-	case "g":
-		if strings.HasPrefix(value, "+") {
-			op.op = SDOP_G_INCR
-		} else if strings.HasPrefix(value, "-") {
-			op.op = SDOP_G_DECR
-		} else {
-			op.op = SDOP_G_SET
-		}
-		ival, err := strconv.ParseInt(value, 10, 64)
-		if err != nil {
-			log.Printf("bad line [%s] from ip [%v]", line, rip)
-			return
-		}
-		op.ival = ival
-		// log.Printf("gauge: op=%d %s=%d", gop, line[0:colon], ival)
-	case "s":
-		//log.Printf("set: %s=%s", line[0:colon], value)
-		op.op = SDOP_S
-		op.sval = value
-	default:
-		log.Printf("bad line [%s] from ip [%v]", line, rip)
+func queueOp(op sdop) {
+	queue := shards[op.shard()].queue
+	if !config.queueDrop {
+		queue <- op
 		return
 	}
+	select {
+	case queue <- op:
+	default:
+		dropOp()
+	}
+}
 
-	queue <- op
+func rejectLine(line []byte, rip net.Addr, bad int) {
+	countBadLine(bad)
+	reportBadLine(line, rip, bad)
 }
 
 // operations:
@@ -210,6 +407,9 @@ func parseLineToQueue(line string, rip net.Addr) {
 // 4. add to gauge [name] intvalue [ival]
 // 5. reduce from gauge [name] intvalue [ival]
 // 6. add to set [name] value strvalue [sval]
+// 7. add to histogram values of [name] floatvalue [fval] sample rate [srate]
+// 8. add to distribution values of [name] floatvalue [fval] sample rate [srate]
+// all operations apply to the series identified by [name] and [tags]
 
 const (
 	SDOP_C_ADD = iota
@@ -218,151 +418,239 @@ const (
 	SDOP_G_INCR
 	SDOP_G_DECR
 	SDOP_S
+	SDOP_H
+	SDOP_D
 )
 
 type sdop struct {
 	op   int
 	name string
+	tags string
 	ival int64
 	fval float64
 	sval string
 	rate float64
 }
 
-// The aggregator thread.
-func aggregator() {
-	// setup
-	area.clear()
-	timer := time.NewTicker(config.flush)
+// key returns the key of the series the operation applies to.
+func (op *sdop) key() string {
+	return op.name + op.tags
+}
 
-	for {
-		select {
-		case op := <-queue:
-			switch op.op {
-			case SDOP_C_ADD:
-				count := op.ival
-				if !math.IsNaN(op.rate) && op.rate != 0 {
-					count = int64(float64(op.ival) / op.rate)
-				}
-				if v, ok := area.counters[op.name]; ok {
-					area.counters[op.name] = v + count
-				} else {
-					area.counters[op.name] = count
-				}
-			case SDOP_T:
-				count := int64(1)
-				if !math.IsNaN(op.rate) && op.rate != 0 {
-					count = int64(1.0 / op.rate)
-				}
-				if v, ok := area.timers[op.name]; ok {
-					v.values = append(v.values, op.fval)
-					v.count += count
-					area.timers[op.name] = v
-				} else {
-					v.values = []float64{op.fval}
-					v.count = count
-					area.timers[op.name] = v
-				}
-			case SDOP_G_SET:
-				area.gauges[op.name] = op.ival
-			case SDOP_G_INCR:
-				if v, ok := area.gauges[op.name]; ok {
-					area.gauges[op.name] = v + op.ival
-				} else {
-					area.gauges[op.name] = op.ival
-				}
-			case SDOP_G_DECR:
-				if v, ok := area.gauges[op.name]; ok {
-					area.gauges[op.name] = v - op.ival
-				} else {
-					// CFG: statsdaemon floors value at 0, statsd does not(?)
-					area.gauges[op.name] = -op.ival
-				}
-			case SDOP_S:
-				if v, ok := area.sets[op.name]; ok {
-					v[op.sval] = true
-				} else {
-					area.sets[op.name] = map[string]bool{op.sval: true}
-				}
-			}
-		case <-timer.C:
-			statsdFlush()
+// apply aggregates the operation into the holding area.
+func (h *HoldingArea) apply(op *sdop) {
+	key := op.key()
+	if limited() && !h.holds(op.op, key) && !admitSeries(key) {
+		return
+	}
+	switch op.op {
+	case SDOP_C_ADD:
+		count := op.ival
+		if !math.IsNaN(op.rate) && op.rate != 0 {
+			count = int64(float64(op.ival) / op.rate)
+		}
+		if v, ok := h.counters[key]; ok {
+			h.counters[key] = v + count
+		} else {
+			h.counters[key] = count
+		}
+	case SDOP_T:
+		addTimerValue(h.timers, key, op)
+	case SDOP_H:
+		addTimerValue(h.histograms, key, op)
+	case SDOP_D:
+		addTimerValue(h.distributions, key, op)
+	case SDOP_G_SET:
+		h.gauges[key] = op.ival
+		h.gaugesAt[key] = time.Now()
+	case SDOP_G_INCR:
+		if v, ok := h.gauges[key]; ok {
+			h.gauges[key] = v + op.ival
+		} else {
+			h.gauges[key] = op.ival
+		}
+		h.gaugesAt[key] = time.Now()
+	case SDOP_G_DECR:
+		if v, ok := h.gauges[key]; ok {
+			h.gauges[key] = v - op.ival
+		} else {
+			// CFG: statsdaemon floors value at 0, statsd does not(?)
+			h.gauges[key] = -op.ival
+		}
+		h.gaugesAt[key] = time.Now()
+	case SDOP_S:
+		if v, ok := h.sets[key]; ok {
+			v[op.sval] = true
+		} else {
+			h.sets[key] = map[string]bool{op.sval: true}
 		}
 	}
 }
 
-// get the p'th percentile value from the sorted list v
-func percentile(v []float64, p int) float64 {
-	s := (float64(p) / 100.0) * float64(len(v))
-	r := int(math.Floor(s + 0.5))
-	if r > 0 && r <= len(v) {
-		return v[r-1]
+// addTimerValue adds the value of a timer, histogram or distribution operation
+// to the values collected for the series key in m.
+func addTimerValue(m map[string]timerInfo, key string, op *sdop) {
+	count := int64(1)
+	if !math.IsNaN(op.rate) && op.rate != 0 {
+		count = int64(1.0 / op.rate)
+	}
+	if v, ok := m[key]; ok {
+		v.values = append(v.values, op.fval)
+		v.count += count
+		m[key] = v
 	} else {
-		return math.NaN()
+		v.values = []float64{op.fval}
+		v.count = count
+		m[key] = v
 	}
 }
 
-func statsdFlush() {
-	result := Stats{
-		At:      time.Now(),
-		Metrics: make(map[string]float64),
-	}
-	//log.Printf("flush @ %v", result.At)
-	for bucket, value := range area.counters {
-		//log.Printf("counter: %s = %.2f", bucket, float64(value))
-		result.add(bucket, float64(value))
+// addGen adds a metric generated from the series bucket, like "my.timer.mean"
+// from "my.timer" or "my.counter.rate" from "my.counter", to the result.
+func addGen(result *Stats, bucket, suffix string, v float64) {
+	metric := seriesGen(bucket, suffix)
+	//log.Printf("gen: %s = %.2f", metric, v)
+	result.add(metric, v)
+	names.AddGen(bucket, metric)
+}
+
+// flushTimer adds the metrics generated from the values collected for a
+// timer, histogram or distribution series to the result. The metrics and the
+// way they are computed are the same as in Etsy statsd, and only the ones
+// selected in the timer stats config are added.
+func flushTimer(result *Stats, bucket string, tinfo timerInfo) {
+	values := tinfo.values
+	count := len(values)
+	// sort the values and get the cumulative sums
+	sort.Float64s(values)
+	cumul := make([]float64, count)
+	cumulSq := make([]float64, count)
+	sum, sumSq := 0.0, 0.0
+	for i, v := range values {
+		sum += v
+		sumSq += v * v
+		cumul[i] = sum
+		cumulSq[i] = sumSq
 	}
-	for bucket, tinfo := range area.timers {
-		values := tinfo.values
-		total := 0.0
-		min := math.Inf(+1)
-		max := math.Inf(-1)
-		for _, v := range values {
-			total += v
-			if v < min {
-				min = v
-			}
-			if v > max {
-				max = v
+	mean := sum / float64(count)
+
+	// stats for each percentile threshold
+	for _, pct := range config.percentiles {
+		n := count
+		if count > 1 {
+			n = int(math.Floor(math.Abs(float64(pct))/100*float64(count) + 0.5))
+			if n == 0 {
+				continue
 			}
 		}
-		mean := total / float64(len(values))
-		// sort the values
-		sort.Float64s(values)
-		if len(values) > 1 {
-			for _, pile := range config.percentiles {
-				if pilev := percentile(values, pile); !math.IsNaN(pilev) {
-					metric := fmt.Sprintf("%s.upper_%d", bucket, pile)
-					//log.Printf("timer: %s = %.2f", metric, pilev)
-					result.add(metric, pilev)
-					names.AddTimerGen(metric)
-				}
+		var thresh, psum, psumSq float64
+		var ps string
+		if pct > 0 {
+			thresh = values[n-1]
+			psum = cumul[n-1]
+			psumSq = cumulSq[n-1]
+			ps = strconv.Itoa(pct)
+		} else {
+			thresh = values[count-n]
+			psum, psumSq = sum, sumSq
+			if n < count {
+				psum -= cumul[count-n-1]
+				psumSq -= cumulSq[count-n-1]
 			}
+			ps = "top" + strconv.Itoa(-pct)
+		}
+		addTimerStat(result, bucket, "count_N", ".count_"+ps, float64(n))
+		addTimerStat(result, bucket, "mean_N", ".mean_"+ps, psum/float64(n))
+		if pct > 0 {
+			addTimerStat(result, bucket, "upper_N", ".upper_"+ps, thresh)
+		} else {
+			addTimerStat(result, bucket, "lower_N", ".lower_"+ps, thresh)
 		}
-		//log.Printf("timer: %s = %.2f", bucket+".mean", mean)
-		result.add(bucket+".mean", mean)
-		names.AddTimerGen(bucket + ".mean")
-		//log.Printf("timer: %s = %.2f", bucket+".lower", min)
-		result.add(bucket+".lower", min)
-		names.AddTimerGen(bucket + ".lower")
-		//log.Printf("timer: %s = %.2f", bucket+".upper", max)
-		result.add(bucket+".upper", max)
-		names.AddTimerGen(bucket + ".upper")
-		//log.Printf("timer: %s = %.2f", bucket+".count", float64(tinfo.count))
-		result.add(bucket+".count", float64(tinfo.count))
-		names.AddTimerGen(bucket + ".count")
-	}
-	for bucket, value := range area.gauges {
-		//log.Printf("gauge: %s = %.2f", bucket, float64(value))
+		addTimerStat(result, bucket, "sum_N", ".sum_"+ps, psum)
+		addTimerStat(result, bucket, "sum_squares_N", ".sum_squares_"+ps, psumSq)
+	}
+
+	// stats for all the values
+	median := values[count/2]
+	if count%2 == 0 {
+		median = (values[count/2-1] + median) / 2
+	}
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	variance /= float64(count)
+	addTimerStat(result, bucket, "std", ".std", math.Sqrt(variance))
+	addTimerStat(result, bucket, "upper", ".upper", values[count-1])
+	addTimerStat(result, bucket, "lower", ".lower", values[0])
+	addTimerStat(result, bucket, "count", ".count", float64(tinfo.count))
+	addTimerStat(result, bucket, "count_ps", ".count_ps", float64(tinfo.count)/config.flush.Seconds())
+	addTimerStat(result, bucket, "sum", ".sum", sum)
+	addTimerStat(result, bucket, "sum_squares", ".sum_squares", sumSq)
+	addTimerStat(result, bucket, "mean", ".mean", mean)
+	addTimerStat(result, bucket, "median", ".median", median)
+	flushHistogram(result, bucket, values)
+}
+
+// addTimerStat adds the generated timer metric if the stat is selected in the
+// timer stats config.
+func addTimerStat(result *Stats, bucket, stat, suffix string, v float64) {
+	if config.timerStats[stat] {
+		addGen(result, bucket, suffix, v)
+	}
+}
+
+// flush adds the metrics of the holding area for the flush at now to the
+// result, and empties the holding h.
+func (h *HoldingArea) flush(result *Stats, now time.Time) {
+	//log.Printf("flush @ %v", now)
+	for bucket, value := range h.counters {
+		//log.Printf("counter: %s = %.2f", bucket, float64(value))
 		result.add(bucket, float64(value))
+		result.addTotal(bucket, promTotal{sum: float64(value)})
+		addGen(result, bucket, ".rate", float64(value)/config.flush.Seconds())
+		h.markSeen(bucket, mtCounter, now).value = float64(value)
+	}
+	for bucket, tinfo := range h.timers {
+		addTimerTotals(result, bucket, tinfo)
+		flushTimer(result, bucket, tinfo)
+		h.markSeen(bucket, mtTimer, now).keepTimer(tinfo)
+	}
+	for bucket, tinfo := range h.histograms {
+		addTimerTotals(result, bucket, tinfo)
+		flushTimer(result, bucket, tinfo)
+		h.markSeen(bucket, mtHistogram, now).keepTimer(tinfo)
 	}
-	for bucket, value := range area.sets {
+	for bucket, tinfo := range h.distributions {
+		addTimerTotals(result, bucket, tinfo)
+		flushTimer(result, bucket, tinfo)
+		h.markSeen(bucket, mtDistribution, now).keepTimer(tinfo)
+	}
+	expired := h.expireGauges(now)
+	for bucket, value := range h.gauges {
+		if h.gaugesAt[bucket].After(h.lastFlush) {
+			//log.Printf("gauge: %s = %.2f", bucket, float64(value))
+			result.add(bucket, float64(value))
+		} else if config.idleGauges == idleLast {
+			result.add(bucket, float64(value))
+		} else if config.idleGauges == idleZero {
+			result.add(bucket, 0)
+		}
+	}
+	for bucket, value := range h.sets {
 		//log.Printf("set: %s = %.2f", bucket, float64(len(value)))
 		result.add(bucket, float64(len(value)))
+		h.markSeen(bucket, mtSet, now).value = float64(len(value))
+	}
+	expired = append(expired, h.flushIdle(result, now)...)
+	if limited() {
+		touchSeries(h.updated(), now)
+		dropSeries(expired)
 	}
-	// store the result
-	names.Add(&area)
-	data.Add(&result)
-	// empty the buckets
-	area.clear()
+	// store the names
+	names.Add(h)
+	names.Remove(expired)
+	// empty the buckets, except for gauges
+	h.clear()
+	h.lastFlush = now
 }
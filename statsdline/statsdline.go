@@ -0,0 +1,324 @@
+// Package statsdline parses statsd protocol lines, including the DogStatsD
+// extensions, like:
+//
+//	gorets:1|c
+//	gorets:1|c|@0.1
+//	glork:320|ms
+//	gaugor:333|g
+//	gaugor:-10|g
+//	uniques:765|s
+//	histo:12.5|h
+//	distro:12.5|d
+//	api.latency:12|ms|@0.5|#env:prod,route:/users
+//	glork:320|ms:100|ms
+//	glork:320:100:55|ms
+//
+// The parser works on byte slices and does not allocate. The metrics it
+// returns refer to the bytes of the line, and are valid only as long as the
+// line is.
+package statsdline
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// Type is the type of a metric.
+type Type int
+
+const (
+	Counter      Type = iota + 1 // c
+	Timer                        // ms
+	Gauge                        // g
+	Set                          // s
+	Histogram                    // h
+	Distribution                 // d
+)
+
+var typeCodes = [...]string{"", "c", "ms", "g", "s", "h", "d"}
+
+// String returns the type as it appears in a statsd line, like "ms".
+func (t Type) String() string {
+	if t < Counter || t > Distribution {
+		return "Type(" + strconv.Itoa(int(t)) + ")"
+	}
+	return typeCodes[t]
+}
+
+// Metric is a single value parsed from a statsd line. A line can have more
+// than one value, like "glork:320:100|ms".
+type Metric struct {
+	Name  []byte
+	Type  Type
+	Value []byte  // the value as it is in the line
+	Int   int64   // the value of counters and gauges
+	Float float64 // the value of timers, histograms and distributions
+	Rate  float64 // the sample rate, or 0 if there is none
+	Tags  []byte  // the DogStatsD tags without the "#", like "env:prod,canary"
+}
+
+// Delta checks if the metric is a gauge update relative to the current value,
+// like "gaugor:-10|g", instead of a new value.
+func (m *Metric) Delta() bool {
+	return m.Type == Gauge && (m.Value[0] == '+' || m.Value[0] == '-')
+}
+
+// Error is the reason a line could not be parsed. Errors are small integers,
+// so they can be used to index tables, and returning one does not allocate.
+type Error int
+
+const (
+	ErrFormat     Error = iota + 1 // no name, value or type
+	ErrValue                       // value not valid for the type
+	ErrType                        // unknown metric type
+	ErrSampleRate                  // sample rate not a number
+	ErrTags                        // tag without a name
+	ErrField                       // unknown field after the type
+)
+
+// NumErrors is one more than the largest Error, for sizing tables indexed by
+// Error.
+const NumErrors = int(ErrField) + 1
+
+var errorNames = [NumErrors]string{
+	"", "format", "value", "type", "sample_rate", "tags", "field",
+}
+
+var errorTexts = [NumErrors]string{
+	"",
+	"statsd: no name, value or type",
+	"statsd: value not valid for the type",
+	"statsd: unknown metric type",
+	"statsd: sample rate not a number",
+	"statsd: tag without a name",
+	"statsd: unknown field after the type",
+}
+
+// Name returns a short name for the error, like "sample_rate".
+func (e Error) Name() string {
+	if e < ErrFormat || e > ErrField {
+		return "unknown"
+	}
+	return errorNames[e]
+}
+
+func (e Error) Error() string {
+	if e < ErrFormat || e > ErrField {
+		return "statsd: unknown error " + strconv.Itoa(int(e))
+	}
+	return errorTexts[e]
+}
+
+// Parse parses a line and appends its metrics to ms. A line is either
+// accepted or rejected as a whole: if there is an error, ms is returned as it
+// was, along with an Error.
+func Parse(line []byte, ms []Metric) ([]Metric, error) {
+	n := len(ms)
+	colon := bytes.IndexByte(line, ':')
+	if colon < 1 || colon == len(line)-1 {
+		return ms, ErrFormat
+	}
+	name := line[:colon]
+	for rest := line[colon+1:]; len(rest) > 0; {
+		var seg []byte
+		seg, rest = nextSegment(rest)
+		var e Error
+		if ms, e = parseSegment(name, seg, ms); e != 0 {
+			return ms[:n], e
+		}
+	}
+	return ms, nil
+}
+
+// NextLine splits off the first line of buf, without the "\n" or "\r\n" at
+// its end. Like bufio.ScanLines, a "\n" at the end of buf does not start
+// another (empty) line.
+func NextLine(buf []byte) (line, rest []byte) {
+	if pos := bytes.IndexByte(buf, '\n'); pos >= 0 {
+		line, rest = buf[:pos], buf[pos+1:]
+	} else {
+		line = buf
+	}
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return
+}
+
+// nextSegment splits off the first "value|type|..." segment from the part of
+// a multi-value line after the name, like "320|ms:100|ms". Colons within
+// DogStatsD tags and container ID fields do not end a segment.
+func nextSegment(s []byte) (seg, rest []byte) {
+	bar := bytes.IndexByte(s, '|')
+	if bar == -1 {
+		return s, nil
+	}
+	for pos, first := bar+1, true; ; first = false {
+		end := bytes.IndexByte(s[pos:], '|')
+		if end == -1 {
+			end = len(s)
+		} else {
+			end += pos
+		}
+		field := s[pos:end]
+		if first || !isTags(field) && !isContainer(field) {
+			if c := bytes.IndexByte(field, ':'); c >= 0 {
+				return s[:pos+c], s[pos+c+1:]
+			}
+		}
+		if end == len(s) {
+			return s, nil
+		}
+		pos = end + 1
+	}
+}
+
+func isTags(field []byte) bool {
+	return len(field) >= 1 && field[0] == '#'
+}
+
+func isContainer(field []byte) bool {
+	return len(field) >= 2 && field[0] == 'c' && field[1] == ':'
+}
+
+// parseSegment parses a segment like "320|ms|@0.1" or the packed form
+// "320:100:55|ms" for the metric name, and appends one metric per value to ms.
+func parseSegment(name, seg []byte, ms []Metric) ([]Metric, Error) {
+	bar1 := bytes.IndexByte(seg, '|')
+	if bar1 < 1 || bar1 == len(seg)-1 {
+		return ms, ErrFormat
+	}
+	code := seg[bar1+1:]
+	var rate float64
+	var tags []byte
+	if bar2 := bytes.IndexByte(code, '|'); bar2 != -1 {
+		fields := code[bar2+1:]
+		code = code[:bar2]
+		for {
+			end := bytes.IndexByte(fields, '|')
+			if end == -1 {
+				end = len(fields)
+			}
+			field := fields[:end]
+			switch {
+			case len(field) >= 2 && field[0] == '@':
+				var err error
+				if rate, err = strconv.ParseFloat(string(field[1:]), 64); err != nil {
+					return ms, ErrSampleRate
+				}
+			case len(field) >= 2 && field[0] == '#':
+				if !validTags(field[1:]) {
+					return ms, ErrTags
+				}
+				tags = field[1:]
+			case isContainer(field), len(field) >= 2 && field[0] == 'T':
+				// DogStatsD container ID and timestamp, ignored
+			default:
+				return ms, ErrField
+			}
+			if end == len(fields) {
+				break
+			}
+			fields = fields[end+1:]
+		}
+	}
+
+	var typ Type
+	switch string(code) {
+	case "c":
+		typ = Counter
+	case "ms":
+		typ = Timer
+	case "g":
+		typ = Gauge
+	case "s":
+		typ = Set
+	case "h":
+		typ = Histogram
+	case "d":
+		typ = Distribution
+	default:
+		return ms, ErrType
+	}
+
+	values := seg[:bar1]
+	for {
+		end := bytes.IndexByte(values, ':')
+		if end == -1 {
+			end = len(values)
+		}
+		m := Metric{Name: name, Type: typ, Value: values[:end], Rate: rate, Tags: tags}
+		var ok bool
+		switch typ {
+		case Counter:
+			m.Int, ok = parseInt(m.Value)
+			ok = ok && m.Int >= 0
+		case Gauge:
+			m.Int, ok = parseInt(m.Value)
+		case Timer, Histogram, Distribution:
+			var err error
+			m.Float, err = strconv.ParseFloat(string(m.Value), 64)
+			ok = err == nil
+		case Set:
+			ok = len(m.Value) > 0
+		}
+		if !ok {
+			return ms, ErrValue
+		}
+		ms = append(ms, m)
+		if end == len(values) {
+			break
+		}
+		values = values[end+1:]
+	}
+	return ms, 0
+}
+
+// parseInt parses a base 10 integer with an optional sign, like
+// strconv.ParseInt does.
+func parseInt(b []byte) (int64, bool) {
+	neg := false
+	if len(b) > 0 && (b[0] == '+' || b[0] == '-') {
+		neg = b[0] == '-'
+		b = b[1:]
+	}
+	if len(b) == 0 {
+		return 0, false
+	}
+	var n uint64
+	for _, c := range b {
+		if c < '0' || c > '9' || n > (1<<63)/10 {
+			return 0, false
+		}
+		n = n*10 + uint64(c-'0')
+		if n > 1<<63 {
+			return 0, false
+		}
+	}
+	if neg {
+		return -int64(n), true
+	}
+	if n == 1<<63 {
+		return 0, false
+	}
+	return int64(n), true
+}
+
+// validTags checks that every tag in a DogStatsD tag list like
+// "env:prod,canary" has a name.
+func validTags(tags []byte) bool {
+	for len(tags) > 0 {
+		end := bytes.IndexByte(tags, ',')
+		if end == -1 {
+			end = len(tags)
+		}
+		if end > 0 && tags[0] == ':' {
+			return false
+		}
+		if end == len(tags) {
+			break
+		}
+		tags = tags[end+1:]
+	}
+	return true
+}
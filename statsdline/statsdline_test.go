@@ -0,0 +1,152 @@
+package statsdline
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+var corpus = []string{
+	"gorets:1|c",
+	"gorets:1|c|@0.1",
+	"glork:320|ms",
+	"glork:320|ms|@0.1",
+	"gaugor:333|g",
+	"gaugor:-10|g",
+	"gaugor:+4|g",
+	"uniques:765|s",
+	"histo:12.5|h",
+	"distro:12.5|d",
+	"api.latency:12|ms|#env:prod,route:/users",
+	"api.latency:12|ms|@0.5|#env:prod|c:abc:def|T1656581400",
+	"glork:320|ms:100|ms",
+	"glork:320:100:55|ms",
+	"big:9223372036854775807|g",
+	"small:-9223372036854775808|g",
+}
+
+// FuzzParse checks that the parser does not panic, and leaves the metrics
+// as they were on errors, that an accepted line parses again the same after
+// being written out anew, and that integer values are accepted exactly when
+// strconv.ParseInt accepts them, with the same value. Run it with
+// "go test -fuzz Parse ./statsdline".
+func FuzzParse(f *testing.F) {
+	for _, line := range corpus {
+		f.Add([]byte(line))
+	}
+	for _, v := range []string{"0", "+4", "-10", "9223372036854775807", "-9223372036854775808", "9223372036854775808"} {
+		f.Add([]byte(v))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkLine(t, b)
+		checkInt(t, b)
+	})
+}
+
+func checkLine(t *testing.T, line []byte) {
+	prefix := []Metric{{Name: []byte("prefix")}}
+	ms, err := Parse(line, prefix)
+	if err != nil {
+		if _, ok := err.(Error); !ok {
+			t.Fatalf("%q: error of type %T", line, err)
+		}
+		if len(ms) != 1 || string(ms[0].Name) != "prefix" {
+			t.Fatalf("%q: metrics changed on error %v", line, err)
+		}
+		return
+	}
+	for _, m := range ms[1:] {
+		again, err := Parse(format(m), nil)
+		if err != nil || len(again) != 1 || !same(m, again[0]) {
+			t.Fatalf("%q: metric %+v parsed again as %+v, %v", line, m, again, err)
+		}
+		if m.Type == Counter || m.Type == Gauge {
+			v, err := strconv.ParseInt(string(m.Value), 10, 64)
+			if err != nil || v != m.Int {
+				t.Fatalf("%q: value %d, strconv says %d, %v", line, m.Int, v, err)
+			}
+		}
+	}
+}
+
+// checkInt compares the parsing of value as a gauge with strconv.ParseInt.
+func checkInt(t *testing.T, value []byte) {
+	if bytes.IndexByte(value, ':') >= 0 || bytes.IndexByte(value, '|') >= 0 {
+		return
+	}
+	ms, err := Parse(append([]byte("x:"), append(value, "|g"...)...), nil)
+	v, serr := strconv.ParseInt(string(value), 10, 64)
+	if (err == nil) != (serr == nil) || err == nil && ms[0].Int != v {
+		t.Fatalf("gauge %q: parsed %+v, %v; strconv says %d, %v", value, ms, err, v, serr)
+	}
+}
+
+// format writes the metric out as a line of its own.
+func format(m Metric) []byte {
+	var b bytes.Buffer
+	b.Write(m.Name)
+	b.WriteByte(':')
+	b.Write(m.Value)
+	b.WriteByte('|')
+	b.WriteString(m.Type.String())
+	if m.Rate != 0 || math.IsNaN(m.Rate) {
+		b.WriteString("|@")
+		b.WriteString(strconv.FormatFloat(m.Rate, 'g', -1, 64))
+	}
+	if len(m.Tags) > 0 {
+		b.WriteString("|#")
+		b.Write(m.Tags)
+	}
+	return b.Bytes()
+}
+
+func same(a, b Metric) bool {
+	if math.IsNaN(a.Float) && math.IsNaN(b.Float) {
+		a.Float, b.Float = 0, 0
+	}
+	if math.IsNaN(a.Rate) && math.IsNaN(b.Rate) {
+		a.Rate, b.Rate = 0, 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+var benchLines = []struct {
+	name string
+	line string
+}{
+	{"counter", "gorets:1|c"},
+	{"counter_rate", "gorets:1|c|@0.1"},
+	{"timer", "glork:320.5|ms"},
+	{"gauge_delta", "gaugor:-10|g"},
+	{"set", "uniques:765|s"},
+	{"tags", "api.latency:12|ms|@0.5|#env:prod,route:/users"},
+	{"multi", "glork:320|ms:100|ms:55|ms"},
+	{"packed", "glork:320:100:55:12:7|ms"},
+	{"bad_value", "gorets:x|c"},
+}
+
+func BenchmarkParse(b *testing.B) {
+	for _, l := range benchLines {
+		line := []byte(l.line)
+		b.Run(l.name, func(b *testing.B) {
+			ms := make([]Metric, 0, 8)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(line)))
+			for i := 0; i < b.N; i++ {
+				ms, _ = Parse(line, ms[:0])
+			}
+		})
+	}
+}
+
+func TestParseAllocs(t *testing.T) {
+	ms := make([]Metric, 0, 8)
+	for _, l := range benchLines {
+		line := []byte(l.line)
+		if n := testing.AllocsPerRun(100, func() { ms, _ = Parse(line, ms[:0]) }); n != 0 {
+			t.Errorf("%s: %v allocations per line", l.name, n)
+		}
+	}
+}
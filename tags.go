@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Metrics with DogStatsD tags are aggregated and stored per series. The key
+// of a series is the metric name followed by its sorted tags, in the Graphite
+// tag format:
+//
+//	api.latency;env=prod;route=/users
+//
+// Tags without a value (DogStatsD allows "#canary") are stored as just the
+// tag name.
+
+var tagReplacer = strings.NewReplacer(";", "_", "=", "_")
+
+// parseTags converts a DogStatsD tag list like "env:prod,route:/users" into
+// the canonical series key suffix ";env=prod;route=/users".
+func parseTags(s string) (string, bool) {
+	parts := strings.Split(s, ",")
+	tags := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if len(p) == 0 {
+			continue
+		}
+		if pos := strings.Index(p, ":"); pos == 0 {
+			return "", false
+		} else if pos > 0 {
+			tags = append(tags, tagReplacer.Replace(p[:pos])+"="+
+				strings.Replace(p[pos+1:], ";", "_", -1))
+		} else {
+			tags = append(tags, tagReplacer.Replace(p))
+		}
+	}
+	if len(tags) == 0 {
+		return "", true
+	}
+	sort.Strings(tags)
+	out := tags[:1]
+	for _, t := range tags[1:] {
+		if t != out[len(out)-1] {
+			out = append(out, t)
+		}
+	}
+	return ";" + strings.Join(out, ";"), true
+}
+
+// splitSeries splits a series key into the metric name and the tags suffix,
+// which is either empty or starts with ";".
+func splitSeries(key string) (name, tags string) {
+	if pos := strings.Index(key, ";"); pos >= 0 {
+		return key[:pos], key[pos:]
+	}
+	return key, ""
+}
+
+// seriesGen returns the key of a series generated from the series key, like
+// "api.latency.mean;env=prod" from "api.latency;env=prod".
+func seriesGen(key, suffix string) string {
+	name, tags := splitSeries(key)
+	return name + suffix + tags
+}
+
+// seriesTags returns the tags of the series key as a map.
+func seriesTags(key string) map[string]string {
+	_, tags := splitSeries(key)
+	if len(tags) == 0 {
+		return nil
+	}
+	out := make(map[string]string)
+	for _, t := range strings.Split(tags[1:], ";") {
+		if pos := strings.Index(t, "="); pos >= 0 {
+			out[t[:pos]] = t[pos+1:]
+		} else {
+			out[t] = ""
+		}
+	}
+	return out
+}
+
+// matchSeries checks if the series key matches the spec. The name part of the
+// spec must be a prefix of the metric name, and each tag in the spec must be
+// present in the series, either as "k=v" or as just "k" to match any value.
+func matchSeries(spec, key string) bool {
+	sname, stags := splitSeries(spec)
+	name, _ := splitSeries(key)
+	if !strings.HasPrefix(name, sname) {
+		return false
+	}
+	if len(stags) == 0 {
+		return true
+	}
+	have := seriesTags(key)
+	for _, t := range strings.Split(stags[1:], ";") {
+		if len(t) == 0 {
+			continue
+		}
+		if pos := strings.Index(t, "="); pos >= 0 {
+			if v, ok := have[t[:pos]]; !ok || v != t[pos+1:] {
+				return false
+			}
+		} else if _, ok := have[t]; !ok {
+			return false
+		}
+	}
+	return true
+}
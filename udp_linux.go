@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// On Linux, datagrams dropped by the kernel because the receive buffer of the
+// UDP socket was full are counted using the SO_RXQ_OVFL socket option. The
+// kernel then reports the number of datagrams dropped so far on the socket
+// along with each datagram that is received.
+
+func listenUDP(addr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	if !reusePort {
+		return net.ListenUDP("udp", addr)
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) (err error) {
+			c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			return
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func setupUDP(sock *udpSocket) {
+	rc, err := sock.conn.SyscallConn()
+	if err != nil {
+		log.Printf("statsd udp: cannot count receive buffer overflows: %v", err)
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RXQ_OVFL, 1)
+	})
+	if err != nil {
+		log.Printf("statsd udp: cannot count receive buffer overflows: %v", err)
+	}
+}
+
+func readUDP(sock *udpSocket, buf, oob []byte) (int, *net.UDPAddr, error) {
+	n, oobn, _, addr, err := sock.conn.ReadMsgUDP(buf, oob)
+	if err == nil && oobn > 0 {
+		if msgs, err := syscall.ParseSocketControlMessage(oob[:oobn]); err == nil {
+			for _, m := range msgs {
+				if m.Header.Level == syscall.SOL_SOCKET &&
+					m.Header.Type == syscall.SO_RXQ_OVFL && len(m.Data) >= 4 {
+					storeOverflows(sock, binary.NativeEndian.Uint32(m.Data))
+				}
+			}
+		}
+	}
+	return n, addr, err
+}
+
+// storeOverflows updates the overflow count of the socket, which can be read
+// by more than one goroutine, so that it never goes back.
+func storeOverflows(sock *udpSocket, n uint32) {
+	for {
+		old := atomic.LoadUint32(&sock.overflows)
+		if n <= old || atomic.CompareAndSwapUint32(&sock.overflows, old, n) {
+			return
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// SO_REUSEPORT and counting kernel receive buffer overflows are supported
+// only on Linux.
+
+func listenUDP(addr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	if reusePort {
+		return nil, errors.New("SO_REUSEPORT is supported only on Linux")
+	}
+	return net.ListenUDP("udp", addr)
+}
+
+func setupUDP(sock *udpSocket) {
+}
+
+func readUDP(sock *udpSocket, buf, oob []byte) (int, *net.UDPAddr, error) {
+	return sock.conn.ReadFromUDP(buf)
+}
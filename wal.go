@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// If a data directory is configured, each flush is also appended to a
+// write-ahead log in it before it is stored, so that the
+// flushes since the last snapshot are not lost if statsd-vis is killed. At
+// startup the flushes in the log that are newer than the snapshot are added
+// to the store.
+//
+// The log is a series of segment files named "wal-<start>.log", with the
+// start time in Unix nanoseconds. A new segment is started at every startup,
+// and every 1/8th of the retention period. Segments with only flushes older
+// than the retention period are removed.
+//
+// A segment is a series of records, each of which is:
+//
+//	length of the body, 4 bytes big endian
+//	CRC-32 (Castagnoli) of the body, 4 bytes big endian
+//	body
+//
+// and the body is the time of the flush in Unix nanoseconds (8 bytes big
+// endian), the number of metrics (uvarint), and for each metric:
+//
+//	length of the name (uvarint), and the name
+//	type of the metric (1 byte, walNoType if unknown)
+//	for generated metrics, the length of the series it was generated from
+//	  (uvarint), the series, and the type of the series (1 byte)
+//	value, as IEEE 754 bits (8 bytes big endian)
+//
+// Reading a segment stops at the first record that is truncated or does not
+// match its checksum, which is what a crash while appending leaves behind.
+
+const walNoType = 0xff
+
+type walSegment struct {
+	path  string
+	start time.Time
+}
+
+var wal struct {
+	file     *os.File
+	segments []walSegment // oldest first, the last one is being written
+}
+
+func walSpan() time.Duration {
+	if span := config.retention / 8; span > config.flush {
+		return span
+	}
+	return config.flush
+}
+
+// walSegments returns the segments in the data directory, oldest first.
+func walSegments() (segs []walSegment) {
+	paths, _ := filepath.Glob(filepath.Join(config.dataDir, "wal-*.log"))
+	for _, p := range paths {
+		ns := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), "wal-"), ".log")
+		if n, err := strconv.ParseInt(ns, 10, 64); err == nil {
+			segs = append(segs, walSegment{path: p, start: time.Unix(0, n)})
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool {
+		return segs[i].start.Before(segs[j].start)
+	})
+	return
+}
+
+// encodeStats encodes the flush as a record body.
+func encodeStats(s *Stats) []byte {
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	putString := func(v string) {
+		buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(len(v)))])
+		buf.WriteString(v)
+	}
+	binary.Write(&buf, binary.BigEndian, s.At.UnixNano())
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(len(s.Metrics)))])
+	for n, v := range s.Metrics {
+		putString(n)
+		t, base, ok := names.Type(n)
+		if !ok {
+			t = walNoType
+		}
+		buf.WriteByte(byte(t))
+		if t == mtGen {
+			putString(base)
+			bt, _, ok := names.Type(base)
+			if !ok {
+				bt = walNoType
+			}
+			buf.WriteByte(byte(bt))
+		}
+		binary.Write(&buf, binary.BigEndian, math.Float64bits(v))
+	}
+	return buf.Bytes()
+}
+
+var errWalRecord = errors.New("bad record")
+
+// decodeStats decodes a record body, and adds the names of the metrics in it
+// that are not known yet.
+func decodeStats(b []byte) (*Stats, error) {
+	r := bytes.NewReader(b)
+	getString := func() (string, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return "", errWalRecord
+		}
+		v := make([]byte, n)
+		r.Read(v)
+		return string(v), nil
+	}
+	var at int64
+	if err := binary.Read(r, binary.BigEndian, &at); err != nil {
+		return nil, errWalRecord
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(r.Len()) {
+		return nil, errWalRecord
+	}
+	s := &Stats{At: time.Unix(0, at), Metrics: make(map[string]float64, count)}
+	for i := uint64(0); i < count; i++ {
+		n, err := getString()
+		if err != nil {
+			return nil, err
+		}
+		t, err := r.ReadByte()
+		if err != nil {
+			return nil, errWalRecord
+		}
+		var base string
+		var bt byte
+		if t == mtGen {
+			if base, err = getString(); err != nil {
+				return nil, err
+			}
+			if bt, err = r.ReadByte(); err != nil {
+				return nil, errWalRecord
+			}
+		}
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, errWalRecord
+		}
+		s.Metrics[n] = math.Float64frombits(bits)
+		if _, _, ok := names.Type(n); ok || t == walNoType || t > mtDistribution {
+			continue
+		}
+		if t == mtGen {
+			names.AddGen(base, n)
+			if _, _, ok := names.Type(base); !ok && bt != mtGen && bt <= mtDistribution {
+				names.Set(base, int(bt))
+			}
+		} else {
+			names.Set(n, int(t))
+		}
+	}
+	return s, nil
+}
+
+// readSegment calls fn for each flush in the segment, and returns the offset
+// of the first bad record, or -1 if there is none.
+func readSegment(path string, fn func(*Stats)) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return -1, err
+	}
+	for off := 0; off < len(b); {
+		if len(b)-off < 8 {
+			return off, nil
+		}
+		n := int(binary.BigEndian.Uint32(b[off:]))
+		sum := binary.BigEndian.Uint32(b[off+4:])
+		if n > len(b)-off-8 {
+			return off, nil
+		}
+		body := b[off+8 : off+8+n]
+		if crc32.Checksum(body, crcTable) != sum {
+			return off, nil
+		}
+		s, err := decodeStats(body)
+		if err != nil {
+			return off, nil
+		}
+		fn(s)
+		off += 8 + n
+	}
+	return -1, nil
+}
+
+// replayWAL stores the flushes in the log that are newer than the latest one
+// stored, and not older than the retention period.
+func replayWAL() {
+	oldest := time.Now().Add(-config.retention)
+	if last := data.Last(); last.After(oldest) {
+		oldest = last
+	}
+	count := 0
+	for _, seg := range walSegments() {
+		bad, err := readSegment(seg.path, func(s *Stats) {
+			if s.At.After(oldest) {
+				data.Add(s)
+				oldest = s.At
+				count++
+			}
+		})
+		if err != nil {
+			log.Printf("cannot read write-ahead log: %v", err)
+		} else if bad >= 0 {
+			log.Printf("write-ahead log %s: bad record at offset %d, skipping the rest",
+				seg.path, bad)
+		}
+	}
+	if count > 0 {
+		log.Printf("replayed %d flushes from the write-ahead log", count)
+	}
+}
+
+// openWAL starts a new segment.
+func openWAL(now time.Time) error {
+	path := filepath.Join(config.dataDir, fmt.Sprintf("wal-%d.log", now.UnixNano()))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if wal.file != nil {
+		wal.file.Close()
+	}
+	wal.file = f
+	wal.segments = append(wal.segments, walSegment{path: path, start: now})
+	return nil
+}
+
+// startWAL replays the write-ahead log into the store and starts a new
+// segment for the flushes to come.
+func startWAL() {
+	replayWAL()
+	wal.segments = walSegments()
+	if err := openWAL(time.Now()); err != nil {
+		log.Fatalf("write-ahead log: %v", err)
+	}
+	truncateWAL(time.Now())
+}
+
+// appendWAL appends the flush to the write-ahead log, and syncs it to disk.
+// It is called from the flusher before the flush is stored.
+func appendWAL(s *Stats) {
+	if last := wal.segments[len(wal.segments)-1]; s.At.Sub(last.start) >= walSpan() {
+		if err := openWAL(s.At); err != nil {
+			log.Printf("cannot start new write-ahead log segment: %v", err)
+		}
+		truncateWAL(s.At)
+	}
+	body := encodeStats(s)
+	rec := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(rec, uint32(len(body)))
+	binary.BigEndian.PutUint32(rec[4:], crc32.Checksum(body, crcTable))
+	rec = append(rec, body...)
+	_, err := wal.file.Write(rec)
+	if err == nil {
+		err = wal.file.Sync()
+	}
+	if err != nil {
+		log.Printf("cannot write to write-ahead log: %v", err)
+	}
+}
+
+// truncateWAL removes the segments with only flushes older than the
+// retention period, that is, those followed by a segment that started before
+// it.
+func truncateWAL(now time.Time) {
+	oldest := now.Add(-config.retention)
+	for len(wal.segments) > 1 && !wal.segments[1].start.After(oldest) {
+		if err := os.Remove(wal.segments[0].path); err != nil && !os.IsNotExist(err) {
+			log.Printf("cannot remove write-ahead log segment: %v", err)
+			return
+		}
+		wal.segments = wal.segments[1:]
+	}
+}
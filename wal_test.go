@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// withSegment writes the flushes into a new write-ahead log segment, and
+// returns its path and the offset of each record.
+func withSegment(t *testing.T, flushes []*Stats) (string, []int) {
+	withDataDir(t, "")
+	saved := wal
+	t.Cleanup(func() {
+		wal.file.Close()
+		wal = saved
+	})
+	wal.file, wal.segments = nil, nil
+	if err := openWAL(flushes[0].At); err != nil {
+		t.Fatal(err)
+	}
+	var offs []int
+	for _, s := range flushes {
+		fi, err := wal.file.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		offs = append(offs, int(fi.Size()))
+		appendWAL(s)
+	}
+	return wal.segments[0].path, offs
+}
+
+func TestSegmentDamagedTail(t *testing.T) {
+	now := time.Now()
+	flushes := make([]*Stats, 3)
+	for i := range flushes {
+		flushes[i] = &Stats{At: now.Add(time.Duration(i) * time.Second),
+			Metrics: map[string]float64{"a": float64(i), "b.c": 1}}
+	}
+	for _, c := range []struct {
+		name   string
+		damage func(b []byte, last int) []byte
+		good   int
+	}{
+		{"none", func(b []byte, last int) []byte { return b }, 3},
+		{"header", func(b []byte, last int) []byte { return b[:last+5] }, 2},
+		{"body", func(b []byte, last int) []byte { return b[:len(b)-3] }, 2},
+		{"checksum", func(b []byte, last int) []byte { b[len(b)-1] ^= 1; return b }, 2},
+		{"length", func(b []byte, last int) []byte { b[last] = 0xff; return b }, 2},
+		{"garbage", func(b []byte, last int) []byte { return append(b, 1, 2, 3, 4, 5, 6, 7, 8, 9) }, 3},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path, offs := withSegment(t, flushes)
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size := len(b)
+			if err := ioutil.WriteFile(path, c.damage(b, offs[2]), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var got []*Stats
+			bad, err := readSegment(path, func(s *Stats) { got = append(got, s) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != c.good {
+				t.Fatalf("read %d flushes, want %d", len(got), c.good)
+			}
+			for i, s := range got {
+				if !s.At.Equal(flushes[i].At) || s.Metrics["a"] != float64(i) || len(s.Metrics) != 2 {
+					t.Errorf("flush %d read as %v %v", i, s.At, s.Metrics)
+				}
+			}
+			switch {
+			case c.name == "none" && bad != -1:
+				t.Errorf("bad record at %d in an undamaged segment", bad)
+			case c.name == "garbage" && bad != size:
+				t.Errorf("bad record at %d, want %d", bad, size)
+			case c.good == 2 && bad != offs[2]:
+				t.Errorf("bad record at %d, want %d", bad, offs[2])
+			}
+		})
+	}
+}
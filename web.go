@@ -8,6 +8,8 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 var tmpl *template.Template
@@ -19,6 +21,9 @@ func startWeb() {
 	template.Must(tmpl.New("dash-error").Parse(tDashError))
 	template.Must(tmpl.New("root").Parse(tRoot))
 	template.Must(tmpl.New("info").Parse(tInfo))
+	template.Must(tmpl.New("badlines").Parse(tBadLines))
+	template.Must(tmpl.New("memory").Parse(tMemory))
+	template.Must(tmpl.New("limits").Parse(tLimits))
 	// register handler
 	http.HandleFunc("/", handler)
 	// start server
@@ -32,29 +37,73 @@ type dataDash struct {
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
-	if strings.HasSuffix(r.URL.Path, "/dash") {
+	if strings.Contains(r.URL.Path, "/api/v1/") {
+		handleAPI(w, r)
+	} else if strings.HasSuffix(r.URL.Path, "/render") {
+		handleRender(w, r)
+	} else if strings.HasSuffix(r.URL.Path, "/metrics/find") {
+		handleFind(w, r)
+	} else if strings.HasSuffix(r.URL.Path, "/metrics") {
+		handlePrometheus(w, r)
+	} else if strings.HasSuffix(r.URL.Path, "/dash") {
 		handleDash(w, r)
+	} else if strings.HasSuffix(r.URL.Path, "/badlines") {
+		handleBadLines(w, r)
+	} else if strings.HasSuffix(r.URL.Path, "/memory") {
+		handleMemory(w, r)
+	} else if strings.HasSuffix(r.URL.Path, "/limits") {
+		handleLimits(w, r)
 	} else {
 		handleList(w, r)
 	}
 }
 
 func handleDash(w http.ResponseWriter, r *http.Request) {
+	// tag filters like "?g=my.timer;env=prod" use semicolons, which are not
+	// query separators for us
+	r.URL.RawQuery = strings.Replace(r.URL.RawQuery, ";", "%3B", -1)
 	g := r.FormValue("g")
 	if len(g) == 0 {
 		render(w, "dash-error", nil)
 		return
 	}
+	var span time.Duration
+	if rs := r.FormValue("range"); len(rs) > 0 {
+		var err error
+		if span, err = parseDuration(rs); err != nil {
+			render(w, "dash-error", nil)
+			return
+		}
+	}
 	parts := strings.Split(g, ",")
 	td := make([]GraphData, 0, len(parts))
-	for i, p := range parts {
+	for _, p := range parts {
 		specs := strings.Split(p, "|")
-		gd := data.GetDataForGraph(names.FindAll(specs))
-		gd.Idx = i
+		metrics := names.FindAll(specs)
+		if series, groups, bins, ok := heatmapBins(metrics); ok {
+			// show timer histograms as heatmaps, one per timer series
+			for j := range series {
+				gd := data.GetDataForGraph(groups[j], span)
+				gd.Idx = len(td)
+				gd.Title = series[j]
+				if gd.Resolution != config.flush {
+					gd.Title += " (" + gd.Resolution.String() + " rollup)"
+				}
+				gd.Heatmap = true
+				gd.Bins = bins[j]
+				td = append(td, gd)
+			}
+			continue
+		}
+		gd := data.GetDataForGraph(metrics, span)
+		gd.Idx = len(td)
 		gd.Title = p
 		if pos := strings.Index(gd.Title, "|"); pos > 0 {
 			gd.Title = gd.Title[:pos] + "+"
 		}
+		if gd.Resolution != config.flush {
+			gd.Title += " (" + gd.Resolution.String() + " rollup)"
+		}
 		td = append(td, gd)
 	}
 	r.URL.RawQuery = ""
@@ -70,45 +119,114 @@ func handleDash(w http.ResponseWriter, r *http.Request) {
 }
 
 type dataList struct {
-	Counters []string
-	Timers   []string
-	Gauges   []string
-	Sets     []string
-	Path     string
-	Empty    bool
-	Config   string
-	Mem      string
+	Counters      []string
+	Timers        []string
+	Gauges        []string
+	Sets          []string
+	Histograms    []string
+	Distributions []string
+	Heatmaps      map[string]string
+	Path          string
+	Empty         bool
+	Config        string
+	Mem           string
+	Queue         string
+	BadLines      uint64
+	BadLinesPath  string
+	MemoryPath    string
+	Limits        string
+	LimitsPath    string
 }
 
 func handleList(w http.ResponseWriter, r *http.Request) {
 	all := names.List()
 	data := dataList{
-		Counters: all[0],
-		Timers:   all[1],
-		Gauges:   all[2],
-		Sets:     all[3],
-		Empty:    len(all[0])+len(all[1])+len(all[2])+len(all[3]) == 0,
+		Counters:      all[mtCounter],
+		Timers:        all[mtTimer],
+		Gauges:        all[mtGauge],
+		Sets:          all[mtSet],
+		Histograms:    all[mtHistogram],
+		Distributions: all[mtDistribution],
 	}
+	data.Empty = len(data.Counters)+len(data.Timers)+len(data.Gauges)+
+		len(data.Sets)+len(data.Histograms)+len(data.Distributions) == 0
 	sort.Strings(data.Counters)
 	sort.Strings(data.Timers)
 	sort.Strings(data.Gauges)
 	sort.Strings(data.Sets)
+	sort.Strings(data.Histograms)
+	sort.Strings(data.Distributions)
+	data.Heatmaps = make(map[string]string)
+	for _, t := range [][]string{data.Timers, data.Histograms, data.Distributions} {
+		for _, n := range t {
+			if findHistogram(n) != nil {
+				data.Heatmaps[n] = seriesGen(n, ".histogram")
+			}
+		}
+	}
 	var stats runtime.MemStats
 	runtime.ReadMemStats(&stats)
 	data.Mem = fmt.Sprintf("resource usage: %.2f MiB heap, %.2f MiB sysvm, %d goroutines",
 		float64(stats.Alloc)/1048576, float64(stats.Sys)/1048576,
 		runtime.NumGoroutine())
+	data.Queue = queueStatus()
 	data.Config = fmt.Sprintf("config: flush interval %v, retention %v, percentiles %v",
 		config.flush, config.retention, config.percentiles)
 	r.URL.RawQuery = ""
 	if !strings.HasSuffix(r.URL.Path, "/") {
 		r.URL.Path += "/"
 	}
-	r.URL.Path = r.URL.Path + "dash"
-	data.Path = "http://" + r.Host + r.URL.String()
+	listPath := "http://" + r.Host + r.URL.String()
+	data.Path = listPath + "dash"
+	data.BadLinesPath = listPath + "badlines"
+	data.MemoryPath = listPath + "memory"
+	data.BadLines = badLineCount()
+	if limited() {
+		data.LimitsPath = listPath + "limits"
+		data.Limits = fmt.Sprintf("limits: %d series, %d rejected, %d evicted",
+			seriesCount(), atomic.LoadUint64(&seriesRejectedTotal),
+			atomic.LoadUint64(&seriesEvictedTotal))
+	}
 	render(w, "root", data)
 }
 
+func handleBadLines(w http.ResponseWriter, r *http.Request) {
+	data := badLineReport()
+	r.URL.RawQuery = ""
+	r.URL.Path = r.URL.Path[:len(r.URL.Path)-8] // ends with "badlines"
+	data.ListPath = "http://" + r.Host + r.URL.String()
+	render(w, "badlines", data)
+}
+
+type dataMemory struct {
+	Series   []seriesMemory
+	Points   int
+	Bytes    int
+	Mem      string
+	ListPath string
+}
+
+func handleLimits(w http.ResponseWriter, r *http.Request) {
+	data := limitsReport()
+	r.URL.RawQuery = ""
+	r.URL.Path = r.URL.Path[:len(r.URL.Path)-6] // ends with "limits"
+	data.ListPath = "http://" + r.Host + r.URL.String()
+	render(w, "limits", data)
+}
+
+func handleMemory(w http.ResponseWriter, r *http.Request) {
+	data := dataMemory{Series: data.Memory()}
+	for _, m := range data.Series {
+		data.Points += m.Points
+		data.Bytes += m.Bytes
+	}
+	data.Mem = fmt.Sprintf("%.2f MiB", float64(data.Bytes)/1048576)
+	r.URL.RawQuery = ""
+	r.URL.Path = r.URL.Path[:len(r.URL.Path)-6] // ends with "memory"
+	data.ListPath = "http://" + r.Host + r.URL.String()
+	render(w, "memory", data)
+}
+
 func render(w http.ResponseWriter, tname string, data interface{}) {
 	if err := tmpl.ExecuteTemplate(w, tname, data); err != nil {
 		log.Print(err)
@@ -177,8 +295,61 @@ const tDash = `
     <script src="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.5/js/bootstrap.min.js"></script>
 	<script src="https://cdnjs.cloudflare.com/ajax/libs/dygraph/1.1.1/dygraph-combined.js"></script>
 	<script type="text/javascript">
+	// heatmap draws the histogram bin counts over time, with one column per
+	// datapoint and one row per bin, darker for higher counts
+	function heatmap(el, title, bins, rows) {
+	  var canvas = document.createElement("canvas");
+	  canvas.width = el.clientWidth;
+	  canvas.height = el.clientHeight;
+	  el.appendChild(canvas);
+	  var ctx = canvas.getContext("2d");
+	  var left = 40, right = 8, top = 26, bottom = 18;
+	  var w = canvas.width - left - right, h = canvas.height - top - bottom;
+	  ctx.font = '14px "Source Sans Pro", sans-serif';
+	  ctx.textAlign = "center";
+	  ctx.fillStyle = "#000";
+	  ctx.fillText(title, canvas.width / 2, 17);
+	  var max = 0;
+	  rows.forEach(function(r) {
+	    for (var i = 1; i < r.length; i++) {
+	      if (r[i] !== null && r[i] > max) { max = r[i]; }
+	    }
+	  });
+	  var cw = w / Math.max(rows.length, 1), ch = h / bins.length;
+	  rows.forEach(function(r, x) {
+	    for (var i = 1; i < r.length; i++) {
+	      if (r[i] === null || r[i] === 0) { continue; }
+	      ctx.fillStyle = "rgba(220,150,86," + (0.15 + 0.85 * r[i] / max) + ")";
+	      ctx.fillRect(left + x * cw, top + h - i * ch, Math.ceil(cw), Math.ceil(ch));
+	    }
+	  });
+	  ctx.font = '10px "Source Sans Pro", sans-serif';
+	  ctx.fillStyle = "#666";
+	  ctx.textAlign = "right";
+	  bins.forEach(function(b, i) {
+	    ctx.fillText(b === "inf" ? b : "<" + b, left - 4, top + h - i * ch - ch / 2 + 3);
+	  });
+	  if (rows.length > 0) {
+	    ctx.textAlign = "left";
+	    ctx.fillText(rows[0][0].toLocaleTimeString(), left, canvas.height - 4);
+	    ctx.textAlign = "right";
+	    ctx.fillText(rows[rows.length - 1][0].toLocaleTimeString(), left + w, canvas.height - 4);
+	  }
+	}
 	$(function() {
 	  {{range .DashData}}
+	  {{if .Heatmap}}
+		heatmap(
+		  document.getElementById("id-{{.Idx}}"),
+		  "{{.Title}}",
+		  [ {{range .Bins}}"{{.}}",{{end}} ],
+		  [
+			{{range .Datapoints}}
+			[ new Date( {{.At.Unix}} * 1000 ), {{.ValuesStr}} ],
+			{{end}}
+		  ]
+		);
+	  {{else}}
 		new Dygraph(
 		  document.getElementById("id-{{.Idx}}"),
 		  [
@@ -198,6 +369,7 @@ const tDash = `
 		  }
 		);
 	  {{end}}
+	  {{end}}
 	  var search = location.search || '';
 	  if (search.indexOf('refresh') !== -1) {
 	    window.setTimeout(function() {
@@ -230,6 +402,8 @@ const tRoot = `
 	.col2, .col2 a {color: #a1b56c}
 	.col3, .col3 a {color: #ba8baf}
 	.col4, .col4 a {color: #dc9656}
+	.col5, .col5 a {color: #86c1b9}
+	.col6, .col6 a {color: #ab4642}
 	.head { background-color: #e8e8e8; font-size: 18px }
 	.head div { display: inline-block; vertical-align: super; padding-top: 4px }
 	</style>
@@ -242,10 +416,12 @@ const tRoot = `
 		</div>
 	  </div>
 	  <div class="row head">
-	  	<div class="col-sm-3"><i class="material-icons col1">plus_one</i> <div>Counters</div></div>
-	  	<div class="col-sm-3"><i class="material-icons col2">timer</i> <div>Timers</div></div>
-	  	<div class="col-sm-3"><i class="material-icons col3">equalizer</i> <div>Gauges</div></div>
-	  	<div class="col-sm-3"><i class="material-icons col4">view_module</i> <div>Sets</div></div>
+	  	<div class="col-sm-2"><i class="material-icons col1">plus_one</i> <div>Counters</div></div>
+	  	<div class="col-sm-2"><i class="material-icons col2">timer</i> <div>Timers</div></div>
+	  	<div class="col-sm-2"><i class="material-icons col3">equalizer</i> <div>Gauges</div></div>
+	  	<div class="col-sm-2"><i class="material-icons col4">view_module</i> <div>Sets</div></div>
+	  	<div class="col-sm-2"><i class="material-icons col5">insert_chart</i> <div>Histograms</div></div>
+	  	<div class="col-sm-2"><i class="material-icons col6">bubble_chart</i> <div>Distributions</div></div>
 	  </div>
 	  {{if .Empty}}
 	  <div class="row" style="padding-top: 2em; text-align: center">
@@ -254,27 +430,40 @@ const tRoot = `
 	  </div>
 	  {{else}}
 	  <div class="row names">
-	    <div class="col-sm-3 col1">
+	    <div class="col-sm-2 col1">
 		{{$path := .Path}}
 		{{range .Counters}}
 		<a href="{{$path}}?g={{.}}">{{.}}</a><br>
 		{{end}}
 		</div>
-	    <div class="col-sm-3 col2">
+	    <div class="col-sm-2 col2">
 		{{range .Timers}}
-		<a href="{{$path}}?g={{.}}">{{.}}</a><br>
+		<a href="{{$path}}?g={{.}}">{{.}}</a>
+		{{with index $.Heatmaps .}}<a href="{{$path}}?g={{.}}" title="heatmap"><small>[heatmap]</small></a>{{end}}<br>
 		{{end}}
 		</div>
-	    <div class="col-sm-3 col3">
+	    <div class="col-sm-2 col3">
 		{{range .Gauges}}
 		<a href="{{$path}}?g={{.}}">{{.}}</a><br>
 		{{end}}
 		</div>
-	    <div class="col-sm-3 col4">
+	    <div class="col-sm-2 col4">
 		{{range .Sets}}
 		<a href="{{$path}}?g={{.}}">{{.}}</a><br>
 		{{end}}
 		</div>
+	    <div class="col-sm-2 col5">
+		{{range .Histograms}}
+		<a href="{{$path}}?g={{.}}">{{.}}</a>
+		{{with index $.Heatmaps .}}<a href="{{$path}}?g={{.}}" title="heatmap"><small>[heatmap]</small></a>{{end}}<br>
+		{{end}}
+		</div>
+	    <div class="col-sm-2 col6">
+		{{range .Distributions}}
+		<a href="{{$path}}?g={{.}}">{{.}}</a>
+		{{with index $.Heatmaps .}}<a href="{{$path}}?g={{.}}" title="heatmap"><small>[heatmap]</small></a>{{end}}<br>
+		{{end}}
+		</div>
 	  </div>
 	  {{end}}
 	  {{template "info" .}}
@@ -282,7 +471,15 @@ const tRoot = `
 	    <p>
 	    {{.Config}}
 		<br>
-	    {{.Mem}}
+	    {{.Mem}} (<a href="{{.MemoryPath}}">by series</a>)
+		<br>
+	    {{.Queue}}
+		<br>
+	    <a href="{{.BadLinesPath}}">{{.BadLines}} bad lines</a>
+		{{if .LimitsPath}}
+		<br>
+	    <a href="{{.LimitsPath}}">{{.Limits}}</a>
+		{{end}}
 	    <p>
 		<a href="https://statsd-vis.info">statsd-vis</a> &mdash; &copy; 2017 <a href="https://www.rapidloop.com/">RapidLoop</a>
 		<br>
@@ -296,6 +493,179 @@ const tRoot = `
 </html>
 `
 
+const tBadLines = `
+<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <meta http-equiv="X-UA-Compatible" content="IE=edge">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>statsd-viz</title>
+    <link href="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.5/css/bootstrap.min.css" rel="stylesheet">
+	<link href='https://fonts.googleapis.com/css?family=Source+Sans+Pro' rel='stylesheet' type='text/css'>
+	<style type="text/css">
+	body { background: #f8f8f8; color: #383838; font-family: "Source Sans Pro", sans-serif; font-size: 16px; }
+	h2 { text-align: center; font-size: 24px; padding: 1.1em; }
+	h3 { font-size: 18px; }
+	.footer { margin: 5em 0 2em 0; color: #999; text-align: center; font-size: 14px }
+	.line { font-family: monospace; word-break: break-all; }
+	</style>
+  </head>
+  <body>
+  	<div class="container-fluid">
+	  <div class="row">
+	    <div class="col-sm-12">
+			<h2>statsd-vis • bad lines</h2>
+		</div>
+	  </div>
+	  <div class="row">
+	    <div class="col-sm-8 col-sm-offset-2">
+		<p>
+		{{.Total}} bad lines received since startup. Bad lines are logged as
+		per the <code>-badlines</code> setting, which is <b>{{.Mode}}</b>.
+		<a href="{{.ListPath}}">Back to the metrics list</a>.
+		{{if .Kinds}}
+		<h3>By reason</h3>
+		<table class="table table-condensed">
+		  <tr><th>Reason</th><th>Count</th></tr>
+		  {{range .Kinds}}
+		  <tr><td>{{.Reason}}</td><td>{{.Count}}</td></tr>
+		  {{end}}
+		</table>
+		<h3>By source</h3>
+		<table class="table table-condensed">
+		  <tr><th>Source</th><th>Count</th><th>Reasons</th><th>Last</th></tr>
+		  {{range .Sources}}
+		  <tr><td>{{.Source}}</td><td>{{.Total}}</td><td>{{.Reasons}}</td><td>{{.Last.Format "15:04:05"}}</td></tr>
+		  {{end}}
+		</table>
+		<h3>Recent</h3>
+		<table class="table table-condensed">
+		  <tr><th>Time</th><th>Source</th><th>Reason</th><th>Line</th></tr>
+		  {{range .Recent}}
+		  <tr><td>{{.At.Format "15:04:05"}}</td><td>{{.Source}}</td><td>{{.Reason}}</td><td class="line">{{.Line}}</td></tr>
+		  {{end}}
+		</table>
+		{{end}}
+		</div>
+	  </div>
+	  <div class="row footer">
+		<a href="https://statsd-vis.info">statsd-vis</a> &mdash; &copy; 2017 <a href="https://www.rapidloop.com/">RapidLoop</a>
+	  </div>
+	</div>
+  </body>
+</html>
+`
+
+const tMemory = `
+<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <meta http-equiv="X-UA-Compatible" content="IE=edge">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>statsd-viz</title>
+    <link href="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.5/css/bootstrap.min.css" rel="stylesheet">
+	<link href='https://fonts.googleapis.com/css?family=Source+Sans+Pro' rel='stylesheet' type='text/css'>
+	<style type="text/css">
+	body { background: #f8f8f8; color: #383838; font-family: "Source Sans Pro", sans-serif; font-size: 16px; }
+	h2 { text-align: center; font-size: 24px; padding: 1.1em; }
+	.footer { margin: 5em 0 2em 0; color: #999; text-align: center; font-size: 14px }
+	td.num, th.num { text-align: right; }
+	</style>
+  </head>
+  <body>
+  	<div class="container-fluid">
+	  <div class="row">
+	    <div class="col-sm-12">
+			<h2>statsd-vis • memory by series</h2>
+		</div>
+	  </div>
+	  <div class="row">
+	    <div class="col-sm-8 col-sm-offset-2">
+		<p>
+		{{len .Series}} series with {{.Points}} values use {{.Mem}}, largest
+		first. <a href="{{.ListPath}}">Back to the metrics list</a>.
+		<table class="table table-condensed">
+		  <tr><th>Series</th><th class="num">Values</th><th class="num">Chunks</th><th class="num">Bytes</th><th class="num">Bytes/value</th></tr>
+		  {{range .Series}}
+		  <tr><td>{{.Name}}</td><td class="num">{{.Points}}</td><td class="num">{{.Chunks}}</td><td class="num">{{.Bytes}}</td><td class="num">{{.BytesPerPoint}}</td></tr>
+		  {{end}}
+		</table>
+		</div>
+	  </div>
+	  <div class="row footer">
+		<a href="https://statsd-vis.info">statsd-vis</a> &mdash; &copy; 2017 <a href="https://www.rapidloop.com/">RapidLoop</a>
+	  </div>
+	</div>
+  </body>
+</html>
+`
+
+const tLimits = `
+<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <meta http-equiv="X-UA-Compatible" content="IE=edge">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>statsd-viz</title>
+    <link href="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.5/css/bootstrap.min.css" rel="stylesheet">
+	<link href='https://fonts.googleapis.com/css?family=Source+Sans+Pro' rel='stylesheet' type='text/css'>
+	<style type="text/css">
+	body { background: #f8f8f8; color: #383838; font-family: "Source Sans Pro", sans-serif; font-size: 16px; }
+	h2 { text-align: center; font-size: 24px; padding: 1.1em; }
+	h3 { font-size: 18px; }
+	.footer { margin: 5em 0 2em 0; color: #999; text-align: center; font-size: 14px }
+	.line { font-family: monospace; word-break: break-all; }
+	td.num, th.num { text-align: right; }
+	</style>
+  </head>
+  <body>
+  	<div class="container-fluid">
+	  <div class="row">
+	    <div class="col-sm-12">
+			<h2>statsd-vis • limits</h2>
+		</div>
+	  </div>
+	  <div class="row">
+	    <div class="col-sm-8 col-sm-offset-2">
+		<p>
+		{{.Series}} series{{if .MaxSeries}} of at most {{.MaxSeries}}{{end}}.
+		{{if .MaxBytes}}The stored values use {{.StoreBytes}} bytes of at most {{.MaxBytes}}.{{end}}
+		New series over the limits are handled as per the <code>-limitpolicy</code>
+		setting, which is <b>{{.Policy}}</b>. {{.RejectedTotal}} values of new
+		series rejected and {{.EvictedTotal}} series evicted since startup.
+		<a href="{{.ListPath}}">Back to the metrics list</a>.
+		{{if .Rejected}}
+		<h3>Rejected</h3>
+		{{if .RejectedCapped}}<p>Only the first {{len .Rejected}} series rejected are listed.{{end}}
+		<table class="table table-condensed">
+		  <tr><th>Series</th><th>Reason</th><th class="num">Values</th><th>Last</th></tr>
+		  {{range .Rejected}}
+		  <tr><td class="line">{{.Series}}</td><td>{{.Reason}}</td><td class="num">{{.Count}}</td><td>{{.Last.Format "15:04:05"}}</td></tr>
+		  {{end}}
+		</table>
+		{{end}}
+		{{if .Evicted}}
+		<h3>Recently evicted</h3>
+		<table class="table table-condensed">
+		  <tr><th>Time</th><th>Series</th><th>Reason</th></tr>
+		  {{range .Evicted}}
+		  <tr><td>{{.At.Format "15:04:05"}}</td><td class="line">{{.Series}}</td><td>{{.Reason}}</td></tr>
+		  {{end}}
+		</table>
+		{{end}}
+		</div>
+	  </div>
+	  <div class="row footer">
+		<a href="https://statsd-vis.info">statsd-vis</a> &mdash; &copy; 2017 <a href="https://www.rapidloop.com/">RapidLoop</a>
+	  </div>
+	</div>
+  </body>
+</html>
+`
+
 const tInfo = `
 <div class="row" style="padding-top: 4em; font-size: 14px">
   <div class="col-sm-8 col-sm-offset-2">
@@ -312,8 +682,22 @@ M<sub>4</sub> in another, use
 <a href="{{.Path}}?g=M1|M2,M3|M4">{{.Path}}?g=M1|M2,M3|M4</a>
 <p>
 M matches an initial prefix of the actual metric name. This is helpful
-when using timers &ndash; so "my.timer" will also match the generated metric names
-"my.timer.lower", "my.timer.upper_95" etc.
+when using timers, histograms and distributions &ndash; so "my.timer" will also match the generated metric names
+"my.timer.lower", "my.timer.upper_95" etc. Counters also have a generated
+per-second rate, like "my.counter.rate".
+<p>
+Timers with histogram bins configured are shown as heatmaps when all the
+metrics in the graph are histogram bins, like
+<a href="{{.Path}}?g=my.timer.histogram">{{.Path}}?g=my.timer.histogram</a>
+<p>
+Metrics sent with DogStatsD tags are stored as one series per unique set of
+tags, named like "my.timer;env=prod;route=/users". To select series by tag,
+append ";tag=value" to M, or just ";tag" to match any value of the tag, like
+<a href="{{.Path}}?g=M;env=prod">{{.Path}}?g=M;env=prod</a>
+<p>
+Append "&amp;range=D" to show only the last D, like "30m" or "7d". Values
+older than the retention period come from the coarser rollups, if there are
+any, like <a href="{{.Path}}?g=M&range=1d">{{.Path}}?g=M&amp;range=1d</a>
 <p style="margin: 0">
 Append "&amp;refresh" to let the page reload itself every minute, like this: <a href="{{.Path}}?g=M&refresh">{{.Path}}?g=M&refresh</a>
       </div>